@@ -19,10 +19,60 @@ const (
 	astCmdConst
 	astCmdFunction
 	astCmdStrTemplate
+	astCmdOperator
+	astCmdSwitch
+	astCmdCase
+	astCmdBreak
+	astCmdContinue
+	astCmdDef
+	astCmdReturn
+	astCmdArray
+	astCmdObject
+	astCmdDelete
+	astCmdUpdate
+	astCmdPathAny
+	astCmdPathDeep
+	astCmdPathFilter
+	astCmdPathSlice
+	astCmdComprehension
+	astCmdTry
+	astCmdAssert
+	astCmdFail
 )
 
 var astCmdNames = []string{"CodeBlock", "If", "VarName", "For", "Foreach", "SetVar", "JsonSet", "Append",
-	"VarPath", "Const", "Function", "StrTemplate"}
+	"VarPath", "Const", "Function", "StrTemplate", "Operator", "Switch", "Case",
+	"Break", "Continue", "Def", "Return", "Array", "Object", "Delete", "Update",
+	"PathAny", "PathDeep", "PathFilter", "PathSlice", "Comprehension", "Try", "Assert", "Fail"}
+
+// updateOperators maps compound assignment to its binary operator, `<<` is deep merge
+var updateOperators = map[string]string{
+	"+=":  "+",
+	"-=":  "-",
+	"*=":  "*",
+	"/=":  "/",
+	"%=":  "%",
+	"<<=": "<<",
+}
+
+// binaryOperators contains precedence of binary operators, higher value binds tighter
+var binaryOperators = map[string]int{
+	"??": 1,
+	"||": 2,
+	"&&": 3,
+	"==": 4,
+	"!=": 4,
+	"<":  5,
+	"<=": 5,
+	">":  5,
+	">=": 5,
+	"in": 5,
+	"+":  6,
+	"-":  6,
+	"*":  7,
+	"/":  7,
+	"%":  7,
+}
 
 func (a astCmd) String() string {
 	if a >= 0 && int(a) < len(astCmdNames) {
@@ -58,6 +108,13 @@ func (a *astNode) str(ident string) string {
 type astParser struct {
 	cur    int
 	tokens []token
+	loops  []string //labels of loops around current position
+	depth  int      //code block nesting level
+
+	filterVars []string //names of current element vars of path filters around current position
+
+	scopes    []map[string]string //declared vars of code blocks around current position: name -> unique var name
+	lastVarId int
 }
 
 func (a *astParser) parse() (*astNode, error) {
@@ -80,13 +137,35 @@ func (a *astParser) nextCommandInCodeBlock() (*astNode, error) {
 	}
 	t := a.tokens[a.cur]
 	switch t.token {
-	case tokenKwEnd, tokenKwElse:
+	case tokenKwEnd, tokenKwElse, tokenKwCase, tokenKwDefault, tokenKwCatch:
 		return nil, nil
 	case tokenKwFor:
-		return a.parseFor()
+		return a.parseFor("")
 	case tokenKwIf:
 		return a.parseIf()
+	case tokenKwSwitch:
+		return a.parseSwitch()
+	case tokenKwBreak, tokenKwContinue:
+		return a.parseLoopControl()
+	case tokenKwDef:
+		return a.parseDef()
+	case tokenKwReturn:
+		return a.parseReturn()
+	case tokenKwDelete:
+		return a.parseDelete()
+	case tokenKwTry:
+		return a.parseTry()
+	case tokenKwAssert:
+		return a.parseAssert()
+	case tokenKwFail:
+		return a.parseFail()
+	case tokenKwLet:
+		return a.parseLet()
 	case tokenWord:
+		if a.cur+2 < len(a.tokens) && a.tokens[a.cur+1].token == tokenColon && a.tokens[a.cur+2].token == tokenKwFor {
+			a.cur += 2
+			return a.parseFor(string(t.data))
+		}
 		return a.parseAssign()
 	}
 
@@ -97,52 +176,62 @@ func (a *astParser) nextCommandInCodeBlock() (*astNode, error) {
 }
 
 func (a *astParser) parseIf() (*astNode, error) {
+	/*
+		child nodes: condition, then block, [condition, then block]..., else block
+		`else if` conditions are in the same node
+	*/
 	t := a.tokens[a.cur]
 	node := &astNode{
 		cmd:   astCmdIf,
 		start: t.start,
-		child: make([]*astNode, 3),
+		child: make([]*astNode, 0, 3),
 	}
 
 	a.cur++
-	var condition, thenDo, elseDo *astNode
-
-	//get condition
-	condition, err := a.parseDataPrimitive()
-	if err != nil {
-		return nil, err
-	}
-	condition.parent = node
-	node.child[0] = condition
+	var elseDo *astNode
+	for {
+		//get condition
+		condition, err := a.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		condition.parent = node
 
-	//get then block
-	thenDo, err = a.parseCodeBlock()
-	if err != nil {
-		return nil, err
-	}
-	thenDo.parent = node
-	if len(thenDo.child) == 0 {
-		thenDo = nil
-	}
-	node.child[1] = thenDo
+		//get then block
+		thenDo, err := a.parseCodeBlock()
+		if err != nil {
+			return nil, err
+		}
+		thenDo.parent = node
+		if len(thenDo.child) == 0 {
+			thenDo = nil
+		}
+		node.child = append(node.child, condition, thenDo)
 
-	//get else block
-	if a.cur >= len(a.tokens) {
-		return nil, ParseError{
-			Msg: ErrUnexpectedIfEnd,
-			Pos: node.start,
+		//get else block
+		if a.cur >= len(a.tokens) {
+			return nil, ParseError{
+				Msg: ErrUnexpectedIfEnd,
+				Pos: node.start,
+			}
+		}
+		t = a.tokens[a.cur]
+		if t.token != tokenKwElse {
+			break
 		}
-	}
-	t = a.tokens[a.cur]
-	if t.token == tokenKwElse {
 		a.cur++
+		if a.cur < len(a.tokens) && a.tokens[a.cur].token == tokenKwIf {
+			a.cur++
+			continue
+		}
 		elseDo, err = a.parseCodeBlock()
 		if err != nil {
 			return nil, err
 		}
 		elseDo.parent = node
-		node.child[2] = elseDo
+		break
 	}
+	node.child = append(node.child, elseDo)
 
 	//check: correct block close
 	if a.cur >= len(a.tokens) {
@@ -164,47 +253,123 @@ func (a *astParser) parseIf() (*astNode, error) {
 	return node, nil
 }
 
-func (a *astParser) parseFor() (*astNode, error) {
+func (a *astParser) parseSwitch() (*astNode, error) {
+	/*
+		child nodes: value, case nodes...
+		case node child nodes: compared values..., code block
+		default case node has data `default` and only code block
+	*/
 	t := a.tokens[a.cur]
 	node := &astNode{
-		cmd:   astCmdFor,
+		cmd:   astCmdSwitch,
 		start: t.start,
-		child: make([]*astNode, 0, 4),
+		child: make([]*astNode, 1, 4),
 	}
 	a.cur++
 
-	//check&init: foreach
-	if a.cur+2 < len(a.tokens) {
-		t1 := a.tokens[a.cur]
-		t2 := a.tokens[a.cur+1]
-		t3 := a.tokens[a.cur+2]
-		if t2.token == tokenKwIn || t3.token == tokenKwIn {
-			node.cmd = astCmdForeach
-			node.child = append(node.child, nil, nil)
-			if t1.token == tokenWord && string(t1.data) != "_" {
-				node.child[0] = a.newVarNameNode(t1, node)
+	value, err := a.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	value.parent = node
+	node.child[0] = value
+
+	hasDefault := false
+	for {
+		if a.cur >= len(a.tokens) {
+			return nil, ParseError{
+				Msg: ErrUnexpectedSwitchEnd,
+				Pos: node.start,
 			}
-			if t2.token == tokenWord && string(t2.data) != "_" {
-				node.child[1] = a.newVarNameNode(t2, node)
+		}
+		t = a.tokens[a.cur]
+		if t.token == tokenKwEnd {
+			break
+		}
+		if hasDefault || (t.token != tokenKwCase && t.token != tokenKwDefault) {
+			return nil, ParseError{
+				Msg: ErrUnexpectedToken,
+				Pos: t.start,
 			}
+		}
+		caseNode := &astNode{
+			cmd:    astCmdCase,
+			start:  t.start,
+			parent: node,
+		}
+		a.cur++
 
-			//set cur to next node after `in`
-			a.cur += 2
-			if t2.token != tokenKwIn {
+		if t.token == tokenKwDefault {
+			hasDefault = true
+			caseNode.data = "default"
+		} else {
+			for {
+				caseValue, err := a.parsePipeline()
+				if err != nil {
+					return nil, err
+				}
+				caseValue.parent = caseNode
+				caseNode.child = append(caseNode.child, caseValue)
+				if a.cur >= len(a.tokens) || a.tokens[a.cur].token != tokenComa {
+					break
+				}
 				a.cur++
 			}
 		}
+
+		actions, err := a.parseCodeBlock()
+		if err != nil {
+			return nil, err
+		}
+		actions.parent = caseNode
+		caseNode.child = append(caseNode.child, actions)
+		caseNode.end = actions.end
+		node.child = append(node.child, caseNode)
+	}
+	node.end = t.end
+	a.cur++
+
+	return node, nil
+}
+
+func (a *astParser) parseFor(label string) (*astNode, error) {
+	t := a.tokens[a.cur]
+	node := &astNode{
+		cmd:   astCmdFor,
+		data:  label,
+		start: t.start,
+		child: make([]*astNode, 0, 4),
+	}
+	a.cur++
+
+	//check&init: foreach
+	if a.parseForeachVars(node) {
+		node.cmd = astCmdForeach
 	}
 
 	//get data source
-	data, err := a.parseDataPrimitive()
+	data, err := a.parsePipeline()
 	if err != nil {
 		return nil, err
 	}
+
+	//foreach vars are visible only inside loop
+	a.pushScope()
+	defer a.popScope()
+	if node.cmd == astCmdForeach {
+		for _, v := range node.child {
+			err = a.declareVar(v)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
 	node.child = append(node.child, data)
 
 	//get actions
+	a.loops = append(a.loops, label)
 	actions, err := a.parseCodeBlock()
+	a.loops = a.loops[:len(a.loops)-1]
 	if err != nil {
 		return nil, err
 	}
@@ -230,6 +395,377 @@ func (a *astParser) parseFor() (*astNode, error) {
 	return node, nil
 }
 
+// parseForeachVars appends key and value var nodes to node if tokens are `key [value] in`
+func (a *astParser) parseForeachVars(node *astNode) bool {
+	if a.cur+2 >= len(a.tokens) {
+		return false
+	}
+	t1 := a.tokens[a.cur]
+	t2 := a.tokens[a.cur+1]
+	t3 := a.tokens[a.cur+2]
+	if t2.token != tokenKwIn && t3.token != tokenKwIn {
+		return false
+	}
+	node.child = append(node.child, nil, nil)
+	n := len(node.child)
+	if t1.token == tokenWord && string(t1.data) != "_" {
+		node.child[n-2] = a.newVarNameNode(t1, node)
+	}
+	if t2.token == tokenWord && string(t2.data) != "_" {
+		node.child[n-1] = a.newVarNameNode(t2, node)
+	}
+
+	//set cur to next node after `in`
+	a.cur += 2
+	if t2.token != tokenKwIn {
+		a.cur++
+	}
+	return true
+}
+
+func (a *astParser) parseTry() (*astNode, error) {
+	/*
+		child nodes: try block, error var (can be nil), catch block
+	*/
+	t := a.tokens[a.cur]
+	node := &astNode{
+		cmd:   astCmdTry,
+		start: t.start,
+		child: make([]*astNode, 3),
+	}
+	a.cur++
+
+	body, err := a.parseCodeBlock()
+	if err != nil {
+		return nil, err
+	}
+	body.parent = node
+	node.child[0] = body
+	if a.cur >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedTryEnd,
+			Pos: node.start,
+		}
+	}
+	t = a.tokens[a.cur]
+	if t.token != tokenKwCatch {
+		return nil, ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: t.start,
+		}
+	}
+	a.cur++
+
+	//optional error var: can't be start of assignment
+	if a.cur < len(a.tokens) && a.tokens[a.cur].token == tokenWord {
+		isVar := true
+		if a.cur+1 < len(a.tokens) {
+			switch a.tokens[a.cur+1].token {
+			case tokenEqual, tokenDot, tokenBracketSO, tokenOperator, tokenColon:
+				isVar = false
+			}
+		}
+		if isVar {
+			//error var is visible only inside catch block
+			a.pushScope()
+			defer a.popScope()
+			node.child[1] = a.newVarNameNode(a.tokens[a.cur], node)
+			err = a.declareVar(node.child[1])
+			if err != nil {
+				return nil, err
+			}
+			a.cur++
+		}
+	}
+
+	catch, err := a.parseCodeBlock()
+	if err != nil {
+		return nil, err
+	}
+	catch.parent = node
+	node.child[2] = catch
+	if a.cur >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedTryEnd,
+			Pos: node.start,
+		}
+	}
+	t = a.tokens[a.cur]
+	if t.token != tokenKwEnd {
+		return nil, ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: t.start,
+		}
+	}
+	node.end = t.end
+	a.cur++
+	return node, nil
+}
+
+func (a *astParser) parseAssert() (*astNode, error) {
+	/*
+		child nodes: condition, [message]
+	*/
+	t := a.tokens[a.cur]
+	node := &astNode{
+		cmd:   astCmdAssert,
+		start: t.start,
+	}
+	a.cur++
+	condition, err := a.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	condition.parent = node
+	node.child = append(node.child, condition)
+	node.end = condition.end
+	if a.cur < len(a.tokens) && a.tokens[a.cur].token == tokenComa {
+		a.cur++
+		msg, err := a.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		msg.parent = node
+		node.child = append(node.child, msg)
+		node.end = msg.end
+	}
+	return node, nil
+}
+
+func (a *astParser) parseFail() (*astNode, error) {
+	/*
+		child nodes: code, message, [data]
+	*/
+	t := a.tokens[a.cur]
+	node := &astNode{
+		cmd:   astCmdFail,
+		start: t.start,
+	}
+	a.cur++
+	if a.cur >= len(a.tokens) || a.tokens[a.cur].token != tokenBracketRO {
+		return nil, ParseError{
+			Msg: ErrFailArgs,
+			Pos: t.start,
+		}
+	}
+	a.cur++
+	err := a.parseList(node, tokenBracketRC, func() error {
+		item, err := a.parsePipeline()
+		if err != nil {
+			return err
+		}
+		item.parent = node
+		node.child = append(node.child, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(node.child) < 2 || len(node.child) > 3 {
+		return nil, ParseError{
+			Msg: ErrFailArgs,
+			Pos: t.start,
+		}
+	}
+	return node, nil
+}
+
+func (a *astParser) parseLoopControl() (*astNode, error) {
+	t := a.tokens[a.cur]
+	if len(a.loops) == 0 {
+		return nil, ParseError{
+			Msg: ErrLoopControlOutsideLoop,
+			Pos: t.start,
+		}
+	}
+	node := &astNode{
+		cmd:   astCmdBreak,
+		start: t.start,
+		end:   t.end,
+	}
+	if t.token == tokenKwContinue {
+		node.cmd = astCmdContinue
+	}
+	a.cur++
+
+	//optional label: should be label of enclosing loop and can't be start of assignment
+	if a.cur >= len(a.tokens) || a.tokens[a.cur].token != tokenWord {
+		return node, nil
+	}
+	if a.cur+1 < len(a.tokens) {
+		switch a.tokens[a.cur+1].token {
+		case tokenEqual, tokenDot, tokenBracketSO, tokenOperator, tokenColon:
+			return node, nil
+		}
+	}
+	label := string(a.tokens[a.cur].data)
+	for _, loopLabel := range a.loops {
+		if loopLabel == label {
+			node.data = label
+			node.end = a.tokens[a.cur].end
+			a.cur++
+			return node, nil
+		}
+	}
+	return nil, ParseError{
+		Msg: ErrUnknownLoopLabel,
+		Pos: a.tokens[a.cur].start,
+	}
+}
+
+func (a *astParser) parseDef() (*astNode, error) {
+	/*
+		child nodes: params..., code block
+	*/
+	t := a.tokens[a.cur]
+	if a.depth != 1 {
+		return nil, ParseError{
+			Msg: ErrNestedDef,
+			Pos: t.start,
+		}
+	}
+	if a.cur+2 >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedDefEnd,
+			Pos: t.start,
+		}
+	}
+	name := a.tokens[a.cur+1]
+	if name.token != tokenWord {
+		return nil, ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: name.start,
+		}
+	}
+	if a.tokens[a.cur+2].token != tokenBracketRO {
+		return nil, ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: a.tokens[a.cur+2].start,
+		}
+	}
+	node := &astNode{
+		cmd:   astCmdDef,
+		data:  string(name.data),
+		start: t.start,
+	}
+	a.cur += 3
+
+	//get params
+	params := map[string]bool{}
+	for a.cur < len(a.tokens) && a.tokens[a.cur].token != tokenBracketRC {
+		if len(params) > 0 {
+			if a.tokens[a.cur].token != tokenComa {
+				return nil, ParseError{
+					Msg: ErrUnexpectedToken,
+					Pos: a.tokens[a.cur].start,
+				}
+			}
+			a.cur++
+		}
+		if a.cur >= len(a.tokens) {
+			break
+		}
+		param := a.tokens[a.cur]
+		paramName := string(param.data)
+		if param.token != tokenWord || params[paramName] || reservedKeywords[paramName] {
+			return nil, ParseError{
+				Msg: ErrVarName,
+				Pos: param.start,
+			}
+		}
+		params[paramName] = true
+		node.child = append(node.child, a.newVarNameNode(param, node))
+		a.cur++
+	}
+	if a.cur >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedDefEnd,
+			Pos: node.start,
+		}
+	}
+	a.cur++
+
+	//get body: vars of main code are not visible inside function
+	scopes := a.scopes
+	a.scopes = nil
+	body, err := a.parseCodeBlock()
+	a.scopes = scopes
+	if err != nil {
+		return nil, err
+	}
+	body.parent = node
+	node.child = append(node.child, body)
+
+	//check: correct block close
+	if a.cur >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedDefEnd,
+			Pos: node.start,
+		}
+	}
+	t = a.tokens[a.cur]
+	if t.token != tokenKwEnd {
+		return nil, ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: t.start,
+		}
+	}
+	node.end = t.end
+	a.cur++
+
+	return node, nil
+}
+
+func (a *astParser) parseReturn() (*astNode, error) {
+	t := a.tokens[a.cur]
+	a.cur++
+	data, err := a.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	node := &astNode{
+		cmd:   astCmdReturn,
+		start: t.start,
+		end:   data.end,
+		child: []*astNode{data},
+	}
+	data.parent = node
+	return node, nil
+}
+
+func (a *astParser) parseDelete() (*astNode, error) {
+	t := a.tokens[a.cur]
+	a.cur++
+	if a.cur >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedConstructionEnd,
+			Pos: t.start,
+		}
+	}
+	if a.tokens[a.cur].token != tokenWord {
+		return nil, ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: a.tokens[a.cur].start,
+		}
+	}
+	pathNode, err := a.parseVarPath()
+	if err != nil {
+		return nil, err
+	}
+	err = a.checkAssignPath(pathNode)
+	if err != nil {
+		return nil, err
+	}
+	node := &astNode{
+		cmd:   astCmdDelete,
+		start: t.start,
+		end:   pathNode.end,
+		child: []*astNode{pathNode},
+	}
+	pathNode.parent = node
+	return node, nil
+}
+
 func (a *astParser) parseAssign() (*astNode, error) {
 	start := a.tokens[a.cur].start
 	if a.cur+2 >= len(a.tokens) {
@@ -246,6 +782,10 @@ func (a *astParser) parseAssign() (*astNode, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = a.checkAssignPath(pathNode)
+	if err != nil {
+		return nil, err
+	}
 
 	if a.cur+1 >= len(a.tokens) {
 		return nil, ParseError{
@@ -256,6 +796,11 @@ func (a *astParser) parseAssign() (*astNode, error) {
 	if a.tokens[a.cur].token == tokenEqual {
 		return a.createJsonSetNode(pathNode)
 	}
+	if t := a.tokens[a.cur]; t.token == tokenOperator {
+		if op, ok := updateOperators[string(t.data)]; ok {
+			return a.createUpdateNode(pathNode, op)
+		}
+	}
 
 	return a.createAppendNode(pathNode)
 }
@@ -268,9 +813,10 @@ func (a *astParser) parseSetVar() (*astNode, error) {
 		child: make([]*astNode, 2),
 	}
 	node.child[0] = a.newVarNameNode(t, node)
+	a.resolveVar(node.child[0])
 	a.cur += 2
 
-	data, err := a.parseDataPrimitive()
+	data, err := a.parsePipeline()
 	if err != nil {
 		return nil, err
 	}
@@ -280,7 +826,73 @@ func (a *astParser) parseSetVar() (*astNode, error) {
 	return node, nil
 }
 
+func (a *astParser) parseLet() (*astNode, error) {
+	/*
+		let name = pipeline
+		let name           -> value is null
+	*/
+	t := a.tokens[a.cur]
+	a.cur++
+	if a.cur >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedConstructionEnd,
+			Pos: t.start,
+		}
+	}
+	name := a.tokens[a.cur]
+	if name.token != tokenWord {
+		return nil, ParseError{
+			Msg: ErrVarName,
+			Pos: name.start,
+		}
+	}
+	node := &astNode{
+		cmd:   astCmdSetVar,
+		start: t.start,
+		end:   name.end,
+		child: make([]*astNode, 2),
+	}
+	a.cur++
+
+	var data *astNode
+	if a.cur < len(a.tokens) && a.tokens[a.cur].token == tokenEqual {
+		a.cur++
+		var err error
+		data, err = a.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		node.end = data.end
+	} else {
+		data = &astNode{
+			cmd:   astCmdConst,
+			data:  "null",
+			start: name.start,
+			end:   name.end,
+		}
+	}
+	data.parent = node
+	node.child[1] = data
+
+	//declare after value: `let x = x` uses outer x
+	node.child[0] = a.newVarNameNode(name, node)
+	err := a.declareVar(node.child[0])
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
 func (a *astParser) parseVarPath() (*astNode, error) {
+	/*
+		child nodes: var name, path items
+		path items:
+		.key, [pipeline]   -> key
+		.*, [*]            -> astCmdPathAny, all children
+		..                 -> astCmdPathDeep, node and all its descendants
+		[?(pipeline)]      -> astCmdPathFilter, children for which pipeline is not empty
+		[start:end:step]   -> astCmdPathSlice, each part is optional
+	*/
 	t := a.tokens[a.cur]
 	node := &astNode{
 		cmd:   astCmdVarPath,
@@ -289,6 +901,7 @@ func (a *astParser) parseVarPath() (*astNode, error) {
 		child: make([]*astNode, 1),
 	}
 	node.child[0] = a.newVarNameNode(t, node)
+	a.resolveVar(node.child[0])
 	a.cur++
 loop:
 	for {
@@ -304,8 +917,39 @@ loop:
 					Pos: t.start,
 				}
 			}
+			if a.tokens[a.cur+1].token == tokenDot {
+				node.child = append(node.child, &astNode{
+					cmd:    astCmdPathDeep,
+					parent: node,
+					start:  t.start,
+					end:    t.end,
+				})
+				a.cur++
+				if a.cur+1 < len(a.tokens) && a.tokens[a.cur+1].token == tokenBracketSO {
+					a.cur++
+					continue
+				}
+				if a.cur+1 >= len(a.tokens) {
+					return nil, ParseError{
+						Msg: ErrUnexpectedConstructionEnd,
+						Pos: t.start,
+					}
+				}
+			}
 			t := a.tokens[a.cur+1]
-			if t.token != tokenWord {
+			if isWildcard(t) {
+				node.child = append(node.child, &astNode{
+					cmd:    astCmdPathAny,
+					parent: node,
+					start:  t.start,
+					end:    t.end,
+				})
+				node.end = t.end
+				a.cur += 2
+				continue
+			}
+			//keywords are allowed as object keys
+			if _, isKeyword := keywords[string(t.data)]; t.token != tokenWord && !isKeyword {
 				return nil, ParseError{
 					Msg: ErrUnexpectedToken,
 					Pos: t.start,
@@ -329,14 +973,30 @@ loop:
 				}
 			}
 			t := a.tokens[a.cur]
-			if a.tokens[a.cur+1].token == tokenBracketSC {
+			next := a.tokens[a.cur+1]
+			if next.token == tokenBracketSC {
 				break loop
 			}
-			a.cur++
-			child, err := a.parseDataPrimitive()
+			a.cur++
+			var child *astNode
+			var err error
+			switch {
+			case isWildcard(next):
+				child = &astNode{
+					cmd:   astCmdPathAny,
+					start: next.start,
+					end:   next.end,
+				}
+				a.cur++
+			case next.token == tokenOperator && string(next.data) == "?":
+				child, err = a.parsePathFilter()
+			default:
+				child, err = a.parsePathKey()
+			}
 			if err != nil {
 				return nil, err
 			}
+			child.parent = node
 			node.child = append(node.child, child)
 			if a.cur >= len(a.tokens) {
 				return nil, ParseError{
@@ -361,9 +1021,119 @@ loop:
 	return node, nil
 }
 
+// parsePathKey parses key pipeline or slice `start:end:step`
+func (a *astParser) parsePathKey() (*astNode, error) {
+	start := a.tokens[a.cur].start
+	items := []*astNode{nil}
+	for {
+		if a.cur >= len(a.tokens) {
+			return nil, ParseError{
+				Msg: ErrUnexpectedConstructionEnd,
+				Pos: start,
+			}
+		}
+		t := a.tokens[a.cur]
+		if t.token == tokenBracketSC {
+			break
+		}
+		if t.token == tokenColon && len(items) < 3 {
+			items = append(items, nil)
+			a.cur++
+			continue
+		}
+		if items[len(items)-1] != nil {
+			return nil, ParseError{
+				Msg: ErrUnexpectedToken,
+				Pos: t.start,
+			}
+		}
+		item, err := a.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		items[len(items)-1] = item
+	}
+	if len(items) == 1 {
+		return items[0], nil
+	}
+
+	node := &astNode{
+		cmd:   astCmdPathSlice,
+		start: start,
+		end:   a.tokens[a.cur].start,
+		child: make([]*astNode, 3),
+	}
+	for i, item := range items {
+		if item != nil {
+			item.parent = node
+		}
+		node.child[i] = item
+	}
+	return node, nil
+}
+
+func isWildcard(t token) bool {
+	return t.token == tokenOperator && string(t.data) == "*"
+}
+
+func (a *astParser) parsePathFilter() (*astNode, error) {
+	t := a.tokens[a.cur]
+	if a.cur+1 >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedConstructionEnd,
+			Pos: t.start,
+		}
+	}
+	if a.tokens[a.cur+1].token != tokenBracketRO {
+		return nil, ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: a.tokens[a.cur+1].start,
+		}
+	}
+	node := &astNode{
+		cmd:   astCmdPathFilter,
+		data:  fmt.Sprintf("$%d", len(a.filterVars)),
+		start: t.start,
+	}
+	a.filterVars = append(a.filterVars, node.data)
+	defer func() {
+		a.filterVars = a.filterVars[:len(a.filterVars)-1]
+	}()
+	a.cur++
+	condition, err := a.parseBrackets()
+	if err != nil {
+		return nil, err
+	}
+	condition.parent = node
+	node.child = []*astNode{condition}
+	node.end = condition.end
+	return node, nil
+}
+
+// checkAssignPath rejects paths which can match several values, slice is allowed only as last path item
+func (a *astParser) checkAssignPath(pathNode *astNode) error {
+	for i, child := range pathNode.child[1:] {
+		switch child.cmd {
+		case astCmdPathAny, astCmdPathDeep, astCmdPathFilter:
+			return ParseError{
+				Msg: ErrWildcardAssign,
+				Pos: child.start,
+			}
+		case astCmdPathSlice:
+			if i != len(pathNode.child)-2 {
+				return ParseError{
+					Msg: ErrSliceAssign,
+					Pos: child.start,
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (a *astParser) createJsonSetNode(pathNode *astNode) (*astNode, error) {
 	a.cur++
-	data, err := a.parseDataPrimitive()
+	data, err := a.parsePipeline()
 	if err != nil {
 		return nil, err
 	}
@@ -378,6 +1148,24 @@ func (a *astParser) createJsonSetNode(pathNode *astNode) (*astNode, error) {
 	return node, nil
 }
 
+func (a *astParser) createUpdateNode(pathNode *astNode, op string) (*astNode, error) {
+	a.cur++
+	data, err := a.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	node := &astNode{
+		cmd:   astCmdUpdate,
+		data:  op,
+		start: pathNode.start,
+		end:   data.end,
+		child: []*astNode{pathNode, data},
+	}
+	pathNode.parent = node
+	data.parent = node
+	return node, nil
+}
+
 func (a *astParser) createAppendNode(pathNode *astNode) (*astNode, error) {
 	if a.cur+3 >= len(a.tokens) {
 		return nil, ParseError{
@@ -405,7 +1193,7 @@ func (a *astParser) createAppendNode(pathNode *astNode) (*astNode, error) {
 	}
 
 	a.cur += 3
-	data, err := a.parseDataPrimitive()
+	data, err := a.parsePipeline()
 	if err != nil {
 		return nil, err
 	}
@@ -420,6 +1208,288 @@ func (a *astParser) createAppendNode(pathNode *astNode) (*astNode, error) {
 	return node, nil
 }
 
+func (a *astParser) parsePipeline() (*astNode, error) {
+	return a.parseBinary(1)
+}
+
+func (a *astParser) parseBinary(minPrecedence int) (*astNode, error) {
+	left, err := a.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for a.cur < len(a.tokens) {
+		t := a.tokens[a.cur]
+		op := string(t.data)
+		precedence := 0
+		switch {
+		case t.token == tokenOperator || t.token == tokenKwIn:
+			precedence = binaryOperators[op]
+		case t.token == tokenNum && op[0] == '-':
+			//tokenizer can't distinct `a -1` and `f(-1)`, so split number to `-` and abs value
+			op = "-"
+			precedence = binaryOperators[op]
+		}
+		if precedence < minPrecedence {
+			break
+		}
+		if t.token == tokenNum {
+			num := t
+			num.data = t.data[1:]
+			num.start.inc(1)
+			a.tokens[a.cur] = num
+		} else {
+			a.cur++
+		}
+		right, err := a.parseBinary(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		node := &astNode{
+			cmd:   astCmdOperator,
+			data:  op,
+			start: t.start,
+			end:   right.end,
+			child: []*astNode{left, right},
+		}
+		left.parent = node
+		right.parent = node
+		left = node
+	}
+	return left, nil
+}
+
+func (a *astParser) parseUnary() (*astNode, error) {
+	if a.cur >= len(a.tokens) {
+		return a.parseDataPrimitive()
+	}
+	t := a.tokens[a.cur]
+	op := string(t.data)
+	if t.token != tokenOperator || (op != "!" && op != "-") {
+		return a.parseDataPrimitive()
+	}
+	a.cur++
+	data, err := a.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	node := &astNode{
+		cmd:   astCmdOperator,
+		data:  op,
+		start: t.start,
+		end:   data.end,
+		child: []*astNode{data},
+	}
+	data.parent = node
+	return node, nil
+}
+
+func (a *astParser) parseBrackets() (*astNode, error) {
+	start := a.tokens[a.cur].start
+	a.cur++
+	node, err := a.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	if a.cur >= len(a.tokens) {
+		return nil, ParseError{
+			Msg: ErrUnexpectedConstructionEnd,
+			Pos: start,
+		}
+	}
+	t := a.tokens[a.cur]
+	if t.token != tokenBracketRC {
+		return nil, ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: t.start,
+		}
+	}
+	a.cur++
+	return node, nil
+}
+
+func (a *astParser) parseArray() (*astNode, error) {
+	/*
+		child nodes: items
+		or comprehension `[item for key val in data if condition]`
+	*/
+	node := &astNode{
+		cmd:   astCmdArray,
+		start: a.tokens[a.cur].start,
+	}
+	a.cur++
+	err := a.parseList(node, tokenBracketSC, func() error {
+		if node.cmd == astCmdComprehension {
+			return ParseError{
+				Msg: ErrUnexpectedToken,
+				Pos: a.tokens[a.cur].start,
+			}
+		}
+		item, err := a.parsePipeline()
+		if err != nil {
+			return err
+		}
+		if len(node.child) == 0 && a.cur < len(a.tokens) && a.tokens[a.cur].token == tokenKwFor {
+			return a.parseComprehension(node, item)
+		}
+		item.parent = node
+		node.child = append(node.child, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (a *astParser) parseObject() (*astNode, error) {
+	/*
+		child nodes: key1, value1, key2, value2 ...
+		or comprehension `{key: value for key val in data if condition}`
+	*/
+	node := &astNode{
+		cmd:   astCmdObject,
+		start: a.tokens[a.cur].start,
+	}
+	a.cur++
+	err := a.parseList(node, tokenBracketCC, func() error {
+		if node.cmd == astCmdComprehension {
+			return ParseError{
+				Msg: ErrUnexpectedToken,
+				Pos: a.tokens[a.cur].start,
+			}
+		}
+		key, err := a.parsePipeline()
+		if err != nil {
+			return err
+		}
+		if a.cur >= len(a.tokens) {
+			return ParseError{
+				Msg: ErrUnexpectedConstructionEnd,
+				Pos: node.start,
+			}
+		}
+		if a.tokens[a.cur].token != tokenColon {
+			return ParseError{
+				Msg: ErrUnexpectedToken,
+				Pos: a.tokens[a.cur].start,
+			}
+		}
+		a.cur++
+		val, err := a.parsePipeline()
+		if err != nil {
+			return err
+		}
+		if len(node.child) == 0 && a.cur < len(a.tokens) && a.tokens[a.cur].token == tokenKwFor {
+			return a.parseComprehension(node, key, val)
+		}
+		key.parent = node
+		val.parent = node
+		node.child = append(node.child, key, val)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// parseComprehension converts array or object literal node to comprehension
+func (a *astParser) parseComprehension(node *astNode, items ...*astNode) error {
+	/*
+		data: array|object
+		child nodes: key var, value var, data, condition, item (key and value for object)
+	*/
+	t := a.tokens[a.cur]
+	data := "array"
+	if node.cmd == astCmdObject {
+		data = "object"
+	}
+	node.cmd = astCmdComprehension
+	node.data = data
+	a.cur++
+	if !a.parseForeachVars(node) {
+		return ParseError{
+			Msg: ErrUnexpectedToken,
+			Pos: t.start,
+		}
+	}
+	source, err := a.parsePipeline()
+	if err != nil {
+		return err
+	}
+	source.parent = node
+
+	//loop vars are visible only inside comprehension, items are parsed before `for`,
+	//so their references to loop vars are renamed after declaration
+	a.pushScope()
+	defer a.popScope()
+	rename := map[string]string{}
+	for _, v := range node.child {
+		if v == nil {
+			continue
+		}
+		outer := &astNode{data: v.data}
+		a.resolveVar(outer)
+		err = a.declareVar(v)
+		if err != nil {
+			return err
+		}
+		rename[outer.data] = v.data
+	}
+	for _, item := range items {
+		renameVars(item, rename)
+	}
+	node.child = append(node.child, source)
+
+	var condition *astNode
+	if a.cur < len(a.tokens) && a.tokens[a.cur].token == tokenKwIf {
+		a.cur++
+		condition, err = a.parsePipeline()
+		if err != nil {
+			return err
+		}
+		condition.parent = node
+	}
+	node.child = append(node.child, condition)
+
+	for _, item := range items {
+		item.parent = node
+		node.child = append(node.child, item)
+	}
+	return nil
+}
+
+// parseList parses coma separated items until closing token
+func (a *astParser) parseList(node *astNode, closeToken tokenType, parseItem func() error) error {
+	for i := 0; ; i++ {
+		if a.cur >= len(a.tokens) {
+			return ParseError{
+				Msg: ErrUnexpectedConstructionEnd,
+				Pos: node.start,
+			}
+		}
+		t := a.tokens[a.cur]
+		if t.token == closeToken {
+			node.end = t.end
+			a.cur++
+			return nil
+		}
+		if i > 0 {
+			if t.token != tokenComa {
+				return ParseError{
+					Msg: ErrUnexpectedToken,
+					Pos: t.start,
+				}
+			}
+			a.cur++
+		}
+		err := parseItem()
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (a *astParser) parseDataPrimitive() (*astNode, error) {
 	if a.cur >= len(a.tokens) {
 		return nil, ParseError{
@@ -428,11 +1498,14 @@ func (a *astParser) parseDataPrimitive() (*astNode, error) {
 		}
 	}
 	/*
-		number|string|object -> astCmdConst
-		dot,word,BracketRO   -> astCmdStrTemplate
-		word,BracketRO       -> astCmdFunction
-		word,dot|BracketSO   -> astCmdVarPath
-		word                 -> astCmdVarName
+		number|string|object|true|false|null -> astCmdConst
+		BracketRO              -> pipeline in brackets
+		BracketSO              -> astCmdArray
+		BracketCO              -> astCmdObject
+		dot,word,BracketRO     -> astCmdStrTemplate
+		word|default,BracketRO -> astCmdFunction
+		word|@,dot|BracketSO   -> astCmdVarPath
+		word|@                 -> astCmdVarName
 	*/
 	var t1, t2, t3 tokenType
 	t := a.tokens[a.cur]
@@ -444,7 +1517,8 @@ func (a *astParser) parseDataPrimitive() (*astNode, error) {
 		t3 = a.tokens[a.cur+2].token
 	}
 	switch {
-	case t1 == tokenNum || t1 == tokenString || t1 == tokenObject:
+	case t1 == tokenNum || t1 == tokenString || t1 == tokenObject ||
+		t1 == tokenKwTrue || t1 == tokenKwFalse || t1 == tokenKwNull:
 		node := &astNode{
 			cmd:   astCmdConst,
 			data:  string(t.data),
@@ -453,15 +1527,23 @@ func (a *astParser) parseDataPrimitive() (*astNode, error) {
 		}
 		a.cur++
 		return node, nil
+	case t1 == tokenBracketRO:
+		return a.parseBrackets()
+	case t1 == tokenBracketSO:
+		return a.parseArray()
+	case t1 == tokenBracketCO:
+		return a.parseObject()
 	case t1 == tokenDot && t2 == tokenWord && t3 == tokenBracketRO:
 		return a.parseStrTemplate()
-	case t1 == tokenWord && t2 == tokenBracketRO:
+	case (t1 == tokenWord || t1 == tokenKwDefault) && t2 == tokenBracketRO:
 		return a.parseFunction()
-	case t1 == tokenWord && (t2 == tokenDot || t2 == tokenBracketSO):
+	case (t1 == tokenWord || t1 == tokenAt) && (t2 == tokenDot || t2 == tokenBracketSO):
 		return a.parseVarPath()
-	case t1 == tokenWord:
+	case t1 == tokenWord || t1 == tokenAt:
 		a.cur++
-		return a.newVarNameNode(t, nil), nil
+		node := a.newVarNameNode(t, nil)
+		a.resolveVar(node)
+		return node, nil
 	}
 	return nil, ParseError{
 		Msg: ErrUnexpectedToken,
@@ -478,7 +1560,7 @@ func (a *astParser) parseStrTemplate() (*astNode, error) {
 	node.child[0] = a.newVarNameNode(a.tokens[a.cur+1], node)
 	a.cur += 3
 
-	data, err := a.parseDataPrimitive()
+	data, err := a.parsePipeline()
 	if err != nil {
 		return nil, err
 	}
@@ -513,8 +1595,13 @@ func (a *astParser) parseFunction() (*astNode, error) {
 	}
 	node.child[0] = a.newVarNameNode(t, node)
 	a.cur += 2
+	if a.cur < len(a.tokens) && a.tokens[a.cur].token == tokenBracketRC {
+		node.end = a.tokens[a.cur].end
+		a.cur++
+		return node, nil
+	}
 	for {
-		data, err := a.parseDataPrimitive()
+		data, err := a.parsePipeline()
 		if err != nil {
 			return nil, err
 		}
@@ -551,6 +1638,12 @@ func (a *astParser) parseCodeBlock() (*astNode, error) {
 	}
 	var err error
 	var child *astNode
+	a.depth++
+	a.pushScope()
+	defer func() {
+		a.depth--
+		a.popScope()
+	}()
 	for err == nil {
 		child, err = a.nextCommandInCodeBlock()
 		if child == nil {
@@ -570,11 +1663,71 @@ func (a *astParser) parseCodeBlock() (*astNode, error) {
 }
 
 func (a *astParser) newVarNameNode(t token, parent *astNode) *astNode {
-	return &astNode{
+	node := &astNode{
 		cmd:    astCmdVarName,
 		parent: parent,
 		data:   string(t.data),
 		start:  t.start,
 		end:    t.end,
 	}
+	//`@` is element of the innermost path filter
+	if t.token == tokenAt && len(a.filterVars) > 0 {
+		node.data = a.filterVars[len(a.filterVars)-1]
+	}
+	return node
+}
+
+// renameVars replaces names of var nodes in tree
+func renameVars(node *astNode, rename map[string]string) {
+	if node == nil {
+		return
+	}
+	if node.cmd == astCmdVarName {
+		if name, ok := rename[node.data]; ok {
+			node.data = name
+		}
+	}
+	for _, child := range node.child {
+		renameVars(child, rename)
+	}
+}
+
+func (a *astParser) pushScope() {
+	a.scopes = append(a.scopes, map[string]string{})
+}
+
+func (a *astParser) popScope() {
+	a.scopes = a.scopes[:len(a.scopes)-1]
+}
+
+// declareVar gives var node unique name visible in the current scope
+func (a *astParser) declareVar(node *astNode) error {
+	if node == nil {
+		return nil
+	}
+	if reservedKeywords[node.data] {
+		return ParseError{
+			Msg: ErrVarName,
+			Pos: node.start,
+		}
+	}
+	a.lastVarId++
+	name := fmt.Sprintf("%s#%d", node.data, a.lastVarId)
+	a.scopes[len(a.scopes)-1][node.data] = name
+	node.data = name
+	return nil
+}
+
+// resolveVar replaces var name with name of declared var from the innermost scope,
+// not declared vars are common for whole template (or function)
+func (a *astParser) resolveVar(node *astNode) {
+	if node == nil {
+		return
+	}
+	for i := len(a.scopes) - 1; i >= 0; i-- {
+		if name, ok := a.scopes[i][node.data]; ok {
+			node.data = name
+			return
+		}
+	}
 }
@@ -350,7 +350,7 @@ func TestAst10(t *testing.T) {
 			{
 				cmd: astCmdForeach,
 				child: []*astNode{
-					{cmd: astCmdVarName, data: "x"},
+					{cmd: astCmdVarName, data: "x#1"},
 					nil,
 					{cmd: astCmdVarName, data: "args"},
 					{
@@ -382,8 +382,8 @@ func TestAst11(t *testing.T) {
 			{
 				cmd: astCmdForeach,
 				child: []*astNode{
-					{cmd: astCmdVarName, data: "key"},
-					{cmd: astCmdVarName, data: "val"},
+					{cmd: astCmdVarName, data: "key#1"},
+					{cmd: astCmdVarName, data: "val#2"},
 					{
 						cmd:   astCmdFunction,
 						child: []*astNode{{cmd: -1}, {cmd: -1}},
@@ -418,7 +418,7 @@ func TestAst12(t *testing.T) {
 				cmd: astCmdForeach,
 				child: []*astNode{
 					nil,
-					{cmd: astCmdVarName, data: "val"},
+					{cmd: astCmdVarName, data: "val#1"},
 					{
 						cmd:   astCmdFunction,
 						child: []*astNode{{cmd: -1}, {cmd: -1}},
@@ -452,7 +452,7 @@ func TestAst13(t *testing.T) {
 			{
 				cmd: astCmdForeach,
 				child: []*astNode{
-					{cmd: astCmdVarName, data: "key"},
+					{cmd: astCmdVarName, data: "key#1"},
 					nil,
 					{
 						cmd:   astCmdFunction,
@@ -470,3 +470,177 @@ func TestAst13(t *testing.T) {
 	}
 	checkAst(t, node, expect, "")
 }
+
+func TestAstOperators(t *testing.T) {
+	code := `result = a -1 * b < 2 && !(c || d)`
+	node, err := text2Ast(code)
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	expect := &astNode{
+		cmd: astCmdCodeBlock,
+		child: []*astNode{
+			{
+				cmd: astCmdSetVar,
+				child: []*astNode{
+					{cmd: astCmdVarName, data: "result"},
+					{
+						cmd:  astCmdOperator,
+						data: "&&",
+						child: []*astNode{
+							{
+								cmd:  astCmdOperator,
+								data: "<",
+								child: []*astNode{
+									{
+										cmd:  astCmdOperator,
+										data: "-",
+										child: []*astNode{
+											{cmd: astCmdVarName, data: "a"},
+											{
+												cmd:  astCmdOperator,
+												data: "*",
+												child: []*astNode{
+													{cmd: astCmdConst, data: "1"},
+													{cmd: astCmdVarName, data: "b"},
+												},
+											},
+										},
+									},
+									{cmd: astCmdConst, data: "2"},
+								},
+							},
+							{
+								cmd:  astCmdOperator,
+								data: "!",
+								child: []*astNode{
+									{cmd: astCmdOperator, data: "||"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	checkAst(t, node, expect, "")
+}
+
+func TestAstElseIf(t *testing.T) {
+	code := `if a
+		result = 1
+	else if b
+	else
+		result = 3
+	end
+	`
+	node, err := text2Ast(code)
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	expect := &astNode{
+		cmd: astCmdCodeBlock,
+		child: []*astNode{
+			{
+				cmd: astCmdIf,
+				child: []*astNode{
+					{cmd: astCmdVarName, data: "a"},
+					{cmd: astCmdCodeBlock, child: []*astNode{{cmd: -1}}},
+					{cmd: astCmdVarName, data: "b"},
+					nil,
+					{cmd: astCmdCodeBlock, child: []*astNode{{cmd: -1}}},
+				},
+			},
+		},
+	}
+	checkAst(t, node, expect, "")
+}
+
+func TestAstSwitch(t *testing.T) {
+	code := `switch args.type
+	case "a", "b"
+		result = 1
+	case "c"
+	default
+		result = 3
+	end
+	`
+	node, err := text2Ast(code)
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	expect := &astNode{
+		cmd: astCmdCodeBlock,
+		child: []*astNode{
+			{
+				cmd: astCmdSwitch,
+				child: []*astNode{
+					{cmd: astCmdVarPath},
+					{
+						cmd: astCmdCase,
+						child: []*astNode{
+							{cmd: astCmdConst, data: `"a"`},
+							{cmd: astCmdConst, data: `"b"`},
+							{cmd: astCmdCodeBlock, child: []*astNode{{cmd: -1}}},
+						},
+					},
+					{
+						cmd: astCmdCase,
+						child: []*astNode{
+							{cmd: astCmdConst, data: `"c"`},
+							{cmd: astCmdCodeBlock},
+						},
+					},
+					{
+						cmd:   astCmdCase,
+						data:  "default",
+						child: []*astNode{{cmd: astCmdCodeBlock, child: []*astNode{{cmd: -1}}}},
+					},
+				},
+			},
+		},
+	}
+	checkAst(t, node, expect, "")
+
+	_, err = text2Ast(`switch x default result = 1 case 2 end`)
+	if err == nil {
+		t.Fatal("case after default should fail")
+	}
+}
+
+func TestAstLiterals(t *testing.T) {
+	code := `result = {"name": key, "items": [1, args.x], key + "_id": {}}`
+	node, err := text2Ast(code)
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	expect := &astNode{
+		cmd: astCmdCodeBlock,
+		child: []*astNode{
+			{
+				cmd: astCmdSetVar,
+				child: []*astNode{
+					{cmd: astCmdVarName, data: "result"},
+					{
+						cmd: astCmdObject,
+						child: []*astNode{
+							{cmd: astCmdConst, data: `"name"`},
+							{cmd: astCmdVarName, data: "key"},
+							{cmd: astCmdConst, data: `"items"`},
+							{
+								cmd: astCmdArray,
+								child: []*astNode{
+									{cmd: astCmdConst, data: `1`},
+									{cmd: astCmdVarPath},
+								},
+							},
+							{cmd: astCmdOperator, data: "+"},
+							{cmd: astCmdObject, child: []*astNode{}},
+						},
+					},
+				},
+			},
+		},
+	}
+	checkAst(t, node, expect, "")
+}
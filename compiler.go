@@ -1,10 +1,12 @@
 package json_template
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"regexp"
+	"strings"
 	"text/template"
 )
 
@@ -12,9 +14,15 @@ type compiler struct {
 	deps           *Options
 	vmCode         []vmCmd
 	opCode         []opCode
+	opCodeDefs     []opCodeDef
+	defs           []vmDef
+	defName2Id     map[string]int
+	constNames     map[string]vmFnArg
+	inDef          bool
 	name2dataPtr   map[string]vmFnArg
 	constData      []reflect.Value
 	functions      []reflect.Value
+	external       []bool //functions from Options, they get plain json values
 	fnName2Id      map[string]int
 	label2CodeLine map[string]int
 	varDataSize    int
@@ -26,7 +34,7 @@ type compiler struct {
 
 func (c *compiler) compile(code string) error {
 	var err error
-	c.opCode, err = c.getOpCode(code)
+	c.opCode, c.opCodeDefs, err = c.getOpCode(code)
 	if err != nil {
 		return err
 	}
@@ -36,31 +44,49 @@ func (c *compiler) compile(code string) error {
 		return err
 	}
 
-	err = c.initOpCodeRefs()
+	err = c.initDefs()
 	if err != nil {
 		return err
 	}
 
-	err = c.buildVmCode()
+	err = c.initOpCodeRefs(c.opCode)
 	if err != nil {
 		return err
 	}
 
+	err = c.checkAssignments(c.opCode, "result", "args")
+	if err != nil {
+		return err
+	}
+
+	err = c.buildVmCode(c.opCode)
+	if err != nil {
+		return err
+	}
+
+	if len(c.defs) > 0 {
+		err = c.compileDefs()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (c *compiler) getOpCode(code string) ([]opCode, error) {
+func (c *compiler) getOpCode(code string) ([]opCode, []opCodeDef, error) {
 	tokens, err := tokenize([]byte(code))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	ap := astParser{tokens: tokens}
 	node, err := ap.parse()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	ob := opCodeBuilder{}
-	return ob.build(node), nil
+	opCode := ob.build(node)
+	return opCode, ob.defs, nil
 }
 
 func (c *compiler) init() error {
@@ -81,9 +107,85 @@ func (c *compiler) init() error {
 		}
 	}
 
+	//consts are visible in all template-defined functions
+	c.constNames = map[string]vmFnArg{}
+	for name, ptr := range c.name2dataPtr {
+		if ptr.isVar == 0 {
+			c.constNames[name] = ptr
+		}
+	}
+
 	return nil
 }
 
+func (c *compiler) initDefs() error {
+	c.defName2Id = map[string]int{}
+	for _, def := range c.opCodeDefs {
+		_, exists := c.defName2Id[def.name]
+		if !exists {
+			_, exists = buildInFunctions[def.name]
+		}
+		if !exists && c.deps != nil {
+			_, exists = c.deps.functions[def.name]
+		}
+		if exists {
+			return RuntimeError{fmt.Errorf("function %s already defined", def.name), def.pos}
+		}
+		c.defName2Id[def.name] = len(c.defs)
+		c.defs = append(c.defs, vmDef{
+			name: def.name,
+		})
+	}
+	return nil
+}
+
+// compileDefs appends code of template-defined functions after main code,
+// each function has own var data
+func (c *compiler) compileDefs() error {
+	//stop execution at the end of main code
+	c.vmCode = append(c.vmCode, vmCmd{cmd: vmCmdRet})
+
+	mainDataSize := c.varDataSize
+	c.inDef = true
+	for i, def := range c.opCodeDefs {
+		c.initUnit()
+		for _, param := range def.params {
+			c.name2dataPtr[param] = vmFnArg{1, c.varDataSize}
+			c.varDataSize++
+		}
+		c.defs[i].entry = len(c.vmCode)
+
+		err := c.initOpCodeRefs(def.code)
+		if err != nil {
+			return err
+		}
+		err = c.checkAssignments(def.code, def.params...)
+		if err != nil {
+			return err
+		}
+		err = c.buildVmCode(def.code)
+		if err != nil {
+			return err
+		}
+		c.defs[i].dataSize = c.varDataSize
+	}
+	c.inDef = false
+	c.varDataSize = mainDataSize
+	return nil
+}
+
+// initUnit resets var data allocation before compile function code
+func (c *compiler) initUnit() {
+	c.name2dataPtr = map[string]vmFnArg{}
+	for name, ptr := range c.constNames {
+		c.name2dataPtr[name] = ptr
+	}
+	c.varDataSize = 0
+	c.tmpVarIsFree = nil
+	c.tmpVar2DataId = nil
+	c.dataId2tmpVar = map[int]int{}
+}
+
 func (c *compiler) initDeps() error {
 	if c.deps.prototype != nil {
 		c.initPrototype()
@@ -150,23 +252,25 @@ func (c *compiler) getFunctionId(name string) (int, error) {
 		fn, ok := c.deps.functions[name]
 		if ok {
 			c.functions = append(c.functions, fn)
+			c.external = append(c.external, true)
 			return id, nil
 		}
 	}
 	rfn, ok := buildInFunctions[name]
 	if ok {
 		c.functions = append(c.functions, rfn)
+		c.external = append(c.external, false)
 		return id, nil
 	}
 
 	return 0, fmt.Errorf("function %s not found", name)
 }
 
-func (c *compiler) initOpCodeRefs() error {
+func (c *compiler) initOpCodeRefs(code []opCode) error {
 	vmCmdId := len(c.vmCode)
-	for _, cmd := range c.opCode {
+	for _, cmd := range code {
 		switch cmd.cmd {
-		case vmCmdCall, vmCmdJmp, vmCmdJmpIfEmpty, vmCmdJmpIfNotEmpty:
+		case vmCmdCall, vmCmdJmp, vmCmdJmpIfEmpty, vmCmdJmpIfNotEmpty, vmCmdRet, vmCmdTry, vmCmdTryEnd:
 			vmCmdId++
 		}
 
@@ -176,10 +280,20 @@ func (c *compiler) initOpCodeRefs() error {
 			if err != nil {
 				return RuntimeError{err, cmd.pos}
 			}
+			if _, isDef := c.defName2Id[cmd.fn]; isDef {
+				continue
+			}
 			_, err = c.getFunctionId(cmd.fn)
 			if err != nil {
 				return RuntimeError{err, cmd.pos}
 			}
+		case vmCmdTry:
+			for _, name := range cmd.fnArgs {
+				err := c.initVarName(name)
+				if err != nil {
+					return RuntimeError{err, cmd.pos}
+				}
+			}
 		case opCmdLabel:
 			c.label2CodeLine[cmd.target] = vmCmdId
 		case opCmdTmpVarFree:
@@ -195,6 +309,113 @@ func (c *compiler) initOpCodeRefs() error {
 	return nil
 }
 
+// checkAssignments walks control flow graph of code and returns error
+// if var can be used on some path before assignment
+func (c *compiler) checkAssignments(code []opCode, assigned ...string) error {
+	labels := map[string]int{}
+	for i, cmd := range code {
+		if cmd.cmd == opCmdLabel {
+			labels[cmd.target] = i
+		}
+	}
+
+	//assigned vars before each command, nil if command is not reached yet
+	in := make([]map[string]bool, len(code)+1)
+	in[0] = map[string]bool{}
+	for _, name := range assigned {
+		in[0][name] = true
+	}
+	queue := []int{0}
+	flow := func(to int, out map[string]bool, extra ...string) {
+		if in[to] == nil {
+			in[to] = map[string]bool{}
+			for name := range out {
+				in[to][name] = true
+			}
+			for _, name := range extra {
+				in[to][name] = true
+			}
+			queue = append(queue, to)
+			return
+		}
+		changed := false
+		for name := range in[to] {
+			if !out[name] && !contains(extra, name) {
+				delete(in[to], name)
+				changed = true
+			}
+		}
+		if changed {
+			queue = append(queue, to)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if i >= len(code) {
+			continue
+		}
+		cmd := code[i]
+		out := in[i]
+		if cmd.cmd == vmCmdCall {
+			out = map[string]bool{cmd.target: true}
+			for name := range in[i] {
+				out[name] = true
+			}
+		}
+		switch cmd.cmd {
+		case vmCmdRet:
+		case vmCmdJmp:
+			flow(labels[cmd.target], out)
+		case vmCmdJmpIfEmpty, vmCmdJmpIfNotEmpty:
+			flow(labels[cmd.target], out)
+			flow(i+1, out)
+		case vmCmdTry:
+			//error can happen before any assignment inside `try` block
+			flow(labels[cmd.target], out, cmd.fnArgs...)
+			flow(i+1, out)
+		default:
+			flow(i+1, out)
+		}
+	}
+
+	for i, cmd := range code {
+		if in[i] == nil {
+			continue
+		}
+		switch cmd.cmd {
+		case vmCmdCall, vmCmdRet, vmCmdJmpIfEmpty, vmCmdJmpIfNotEmpty:
+		default:
+			continue
+		}
+		for _, name := range cmd.fnArgs {
+			ptr, ok := c.name2dataPtr[name]
+			if !ok || ptr.isVar == 0 || in[i][name] {
+				continue
+			}
+			return RuntimeError{fmt.Errorf("variable `%s` is possibly used before assignment", varDisplayName(name)), cmd.pos}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// varDisplayName returns var name from template code, block vars have unique suffix
+func varDisplayName(name string) string {
+	if i := strings.IndexByte(name, '#'); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
 func (c *compiler) initVarName(name string) error {
 	ptr, ok := c.name2dataPtr[name]
 	if ok {
@@ -204,6 +425,10 @@ func (c *compiler) initVarName(name string) error {
 		return nil
 	}
 
+	if c.inDef && (name == "result" || name == "args") {
+		return fmt.Errorf("`%s` is not available inside function", name)
+	}
+
 	if name[0] != '@' {
 		//named var
 		ptr = vmFnArg{1, c.varDataSize}
@@ -267,6 +492,7 @@ func (c *compiler) initInlineConst(name string, data string) error {
 }
 
 func (c *compiler) inlineConstValue(data string) (reflect.Value, error) {
+	data = string(stripJsonComments([]byte(data)))
 	var v interface{}
 	err := json.Unmarshal([]byte(data), &v)
 	if err != nil {
@@ -276,23 +502,37 @@ func (c *compiler) inlineConstValue(data string) (reflect.Value, error) {
 	switch v.(type) {
 	case []interface{}, map[string]interface{}:
 		v = json.RawMessage(data)
+	case nil:
+		//valid value of interface type, so null can be passed as argument
+		return reflect.ValueOf(&v).Elem(), nil
 	}
 
 	return reflect.ValueOf(v), nil
 }
 
-func (c *compiler) buildVmCode() error {
+func (c *compiler) buildVmCode(code []opCode) error {
 
 loop:
-	for _, cmd := range c.opCode {
+	for _, cmd := range code {
 		var vmCmd vmCmd
 		var err error
 
 		switch cmd.cmd {
 		case vmCmdCall:
+			if _, isDef := c.defName2Id[cmd.fn]; isDef {
+				vmCmd, err = c.vmCmdCallDef(cmd)
+				break
+			}
 			vmCmd, err = c.vmCmdCall(cmd)
+		case vmCmdRet:
+			vmCmd, err = c.vmCmdRet(cmd)
 		case vmCmdJmp:
 			vmCmd, err = c.vmCmdJmp(cmd)
+		case vmCmdTry:
+			vmCmd, err = c.vmCmdTry(cmd)
+		case vmCmdTryEnd:
+			vmCmd.cmd = vmCmdTryEnd
+			vmCmd.codePos = cmd.pos
 		case vmCmdJmpIfEmpty, vmCmdJmpIfNotEmpty:
 			vmCmd, err = c.vmCmdJmpIf(cmd)
 		default:
@@ -309,24 +549,24 @@ loop:
 
 func (c *compiler) vmCmdCall(code opCode) (vmCmd, error) {
 	fnId, _ := c.getFunctionId(code.fn)
-	args := make([]vmFnArg, len(code.fnArgs))
-	for i, argName := range code.fnArgs {
-		argPtr, ok := c.name2dataPtr[argName]
-		if !ok {
-			return vmCmd{}, fmt.Errorf("Unexpected reference `%s` in function %s call", argName, code.fn)
-		}
-		args[i] = argPtr
+	args, err := c.vmFnArgs(code)
+	if err != nil {
+		return vmCmd{}, err
 	}
 
 	//validate args number if function call
 	sign := c.functions[fnId].Type()
+	numIn := sign.NumIn()
+	if withVm(sign) {
+		numIn--
+	}
 	if sign.IsVariadic() {
-		if len(args) < sign.NumIn()-1 {
-			return vmCmd{}, fmt.Errorf("wrong number of args for %s: want at least %d got %d", code.fn, sign.NumIn()-1, len(args))
+		if len(args) < numIn-1 {
+			return vmCmd{}, fmt.Errorf("wrong number of args for %s: want at least %d got %d", code.fn, numIn-1, len(args))
 		}
 	} else {
-		if len(args) != sign.NumIn() {
-			return vmCmd{}, fmt.Errorf("wrong number of args for %s: want %d got %d", code.fn, sign.NumIn(), len(args))
+		if len(args) != numIn {
+			return vmCmd{}, fmt.Errorf("wrong number of args for %s: want %d got %d", code.fn, numIn, len(args))
 		}
 	}
 
@@ -340,6 +580,53 @@ func (c *compiler) vmCmdCall(code opCode) (vmCmd, error) {
 	}, nil
 }
 
+func (c *compiler) vmCmdCallDef(code opCode) (vmCmd, error) {
+	defId := c.defName2Id[code.fn]
+	args, err := c.vmFnArgs(code)
+	if err != nil {
+		return vmCmd{}, err
+	}
+
+	//validate args number
+	paramsNum := len(c.opCodeDefs[defId].params)
+	if len(args) != paramsNum {
+		return vmCmd{}, fmt.Errorf("wrong number of args for %s: want %d got %d", code.fn, paramsNum, len(args))
+	}
+
+	ptr := c.name2dataPtr[code.target]
+	return vmCmd{
+		cmd:     vmCmdCallDef,
+		target:  ptr.dataId,
+		fn:      defId,
+		fnArgs:  args,
+		codePos: code.pos,
+	}, nil
+}
+
+func (c *compiler) vmCmdRet(code opCode) (vmCmd, error) {
+	args, err := c.vmFnArgs(code)
+	if err != nil {
+		return vmCmd{}, err
+	}
+	return vmCmd{
+		cmd:     code.cmd,
+		fnArgs:  args,
+		codePos: code.pos,
+	}, nil
+}
+
+func (c *compiler) vmFnArgs(code opCode) ([]vmFnArg, error) {
+	args := make([]vmFnArg, len(code.fnArgs))
+	for i, argName := range code.fnArgs {
+		argPtr, ok := c.name2dataPtr[argName]
+		if !ok {
+			return nil, fmt.Errorf("Unexpected reference `%s` in function %s call", argName, code.fn)
+		}
+		args[i] = argPtr
+	}
+	return args, nil
+}
+
 func (c *compiler) vmCmdJmp(code opCode) (vmCmd, error) {
 	target, ok := c.label2CodeLine[code.target]
 	if !ok {
@@ -353,6 +640,15 @@ func (c *compiler) vmCmdJmp(code opCode) (vmCmd, error) {
 
 }
 
+func (c *compiler) vmCmdTry(code opCode) (vmCmd, error) {
+	cmd, err := c.vmCmdJmp(code)
+	if err != nil {
+		return vmCmd{}, err
+	}
+	cmd.fnArgs, err = c.vmFnArgs(code)
+	return cmd, err
+}
+
 func (c *compiler) vmCmdJmpIf(code opCode) (vmCmd, error) {
 	target, ok := c.label2CodeLine[code.target]
 	if !ok {
@@ -371,3 +667,59 @@ func (c *compiler) vmCmdJmpIf(code opCode) (vmCmd, error) {
 		fnArgs:  []vmFnArg{argPtr},
 	}, nil
 }
+
+// stripJsonComments replaces `#`, `//` and `/* */` comments outside of json strings with spaces,
+// new lines are kept, so json error positions are not changed
+func stripJsonComments(data []byte) []byte {
+	var res []byte
+	inString := false
+	for i := 0; i < len(data); i++ {
+		char := data[i]
+		if inString {
+			switch char {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		end := i
+		switch {
+		case char == '"':
+			inString = true
+			continue
+		case char == '#' || bytes.HasPrefix(data[i:], []byte("//")):
+			end = bytes.IndexByte(data[i:], '\n')
+			if end < 0 {
+				end = len(data)
+			} else {
+				end += i
+			}
+		case bytes.HasPrefix(data[i:], []byte("/*")):
+			end = bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				//keep as is, json decoder will report error
+				return data
+			}
+			end += i + 4
+		default:
+			continue
+		}
+
+		if res == nil {
+			res = append([]byte{}, data...)
+		}
+		for j := i; j < end; j++ {
+			if res[j] != '\n' {
+				res[j] = ' '
+			}
+		}
+		i = end - 1
+	}
+	if res == nil {
+		return data
+	}
+	return res
+}
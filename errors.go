@@ -14,12 +14,36 @@ func (e RuntimeError) Error() string {
 	return fmt.Sprintf("[%d:%d] %s", e.Pos.line, e.Pos.column, e.Err.Error())
 }
 
+func (e RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// TemplateError is error raised by template with `assert` or `fail` statement
+type TemplateError struct {
+	Code    string
+	Message string
+	Data    interface{}
+	Pos     Position
+}
+
+func (e TemplateError) Error() string {
+	return fmt.Sprintf("[%d:%d] %s: %s", e.Pos.line, e.Pos.column, e.Code, e.Message)
+}
+
 type Position struct {
 	offset int
 	line   int
 	column int
 }
 
+func (p Position) Line() int {
+	return p.line
+}
+
+func (p Position) Column() int {
+	return p.column
+}
+
 func (p *Position) inc(i int) {
 	p.offset += i
 	p.column += i
@@ -38,6 +62,16 @@ var ErrIncorrectName = errors.New("Incorrect name")
 var ErrNotFunction = errors.New("Value is not a function")
 var ErrIncorrectFunction = errors.New("Incorrect function")
 
+// execution limits errors, they can't be caught by `try` block
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+var ErrLoopIterationLimit = errors.New("loop iteration limit exceeded")
+var ErrCallDepthLimit = errors.New("call depth limit exceeded")
+var ErrArrayGapLimit = errors.New("array index gap limit exceeded")
+var ErrOutputNodesLimit = errors.New("output nodes limit exceeded")
+var ErrOutputBytesLimit = errors.New("output bytes limit exceeded")
+var ErrStringLengthLimit = errors.New("string length limit exceeded")
+var ErrDepthLimit = errors.New("nesting depth limit exceeded")
+
 const (
 	ErrParseNumber               = "error in numeric token"
 	ErrUnexpectedSymbol          = "unexpected symbol"
@@ -49,4 +83,14 @@ const (
 	ErrUnexpectedConstructionEnd = "unexpected construction end"
 	ErrUnexpectedForEnd          = "unexpected end in `for` block "
 	ErrVarName                   = "inadmissible var name"
+	ErrUnexpectedCommentEnd      = "unexpected end of comment"
+	ErrUnexpectedSwitchEnd       = "unexpected end in `switch` block "
+	ErrLoopControlOutsideLoop    = "`break` or `continue` outside of loop"
+	ErrUnknownLoopLabel          = "unknown loop label"
+	ErrUnexpectedDefEnd          = "unexpected end in `def` block "
+	ErrNestedDef                 = "function can be defined only at top level"
+	ErrWildcardAssign            = "wildcard, recursive descent or filter can't be used in assignment"
+	ErrSliceAssign               = "slice can be used only as last item of assignment path"
+	ErrUnexpectedTryEnd          = "unexpected end in `try` block "
+	ErrFailArgs                  = "`fail` expects code, message and optional data"
 )
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"text/template"
 )
 
@@ -22,9 +24,16 @@ func init() {
 	buildInFunctions["@iteratorVal"] = reflect.ValueOf(iteratorValue)
 	buildInFunctions["@strTemplate"] = reflect.ValueOf(strTemplate)
 	buildInFunctions["@get"] = reflect.ValueOf(jsonGet)
+	buildInFunctions["@pathAny"] = reflect.ValueOf(pathAnyItem)
+	buildInFunctions["@pathDeep"] = reflect.ValueOf(pathDeepItem)
+	buildInFunctions["@pathSlice"] = reflect.ValueOf(newPathSlice)
 	buildInFunctions["@jsonSet"] = reflect.ValueOf(jsonSet)
 	buildInFunctions["@append"] = reflect.ValueOf(jsonAppend)
+	buildInFunctions["@delete"] = reflect.ValueOf(jsonDelete)
+	buildInFunctions["@merge"] = reflect.ValueOf(jsonMerge)
 	buildInFunctions["@clone"] = reflect.ValueOf(clone)
+	buildInFunctions["@share"] = reflect.ValueOf(share)
+	buildInFunctions["@result"] = reflect.ValueOf(setResult)
 
 	buildInFunctions["eq"] = reflect.ValueOf(eq)
 	buildInFunctions["sum"] = reflect.ValueOf(sum)
@@ -32,6 +41,31 @@ func init() {
 	buildInFunctions["or"] = reflect.ValueOf(or)
 	buildInFunctions["and"] = reflect.ValueOf(and)
 	buildInFunctions["not"] = reflect.ValueOf(not)
+
+	buildInFunctions["@bool"] = reflect.ValueOf(toBool)
+	buildInFunctions["@value"] = reflect.ValueOf(value)
+	buildInFunctions["@isSet"] = reflect.ValueOf(isSet)
+	buildInFunctions["default"] = reflect.ValueOf(defaultValue)
+	buildInFunctions["range"] = reflect.ValueOf(newRange)
+	buildInFunctions["sorted"] = reflect.ValueOf(sorted)
+	buildInFunctions["sortBy"] = reflect.ValueOf(sortBy)
+	buildInFunctions["@fail"] = reflect.ValueOf(fail)
+	buildInFunctions["@add"] = reflect.ValueOf(add)
+	buildInFunctions["@sub"] = reflect.ValueOf(sub)
+	buildInFunctions["@mul"] = reflect.ValueOf(mul)
+	buildInFunctions["@div"] = reflect.ValueOf(div)
+	buildInFunctions["@mod"] = reflect.ValueOf(mod)
+	buildInFunctions["@neg"] = reflect.ValueOf(neg)
+	buildInFunctions["@ne"] = reflect.ValueOf(ne)
+	buildInFunctions["@lt"] = reflect.ValueOf(lt)
+	buildInFunctions["@le"] = reflect.ValueOf(le)
+	buildInFunctions["@gt"] = reflect.ValueOf(gt)
+	buildInFunctions["@ge"] = reflect.ValueOf(ge)
+	buildInFunctions["@in"] = reflect.ValueOf(in)
+	buildInFunctions["@array"] = reflect.ValueOf(array)
+	buildInFunctions["@object"] = reflect.ValueOf(object)
+	buildInFunctions["@push"] = reflect.ValueOf(push)
+	buildInFunctions["@put"] = reflect.ValueOf(put)
 }
 
 func clone(v interface{}) (interface{}, error) {
@@ -47,51 +81,471 @@ func clone(v interface{}) (interface{}, error) {
 	return json.RawMessage(data), nil
 }
 
-func strTemplate(t *template.Template, params interface{}) (string, error) {
+// share returns value which is used in one more place, containers of shared value are copied before change
+func share(v *vm, val interface{}) interface{} {
+	return v.share(val)
+}
+
+// setResult returns value assigned to result as whole, it is checked and counted by output limits
+func setResult(v *vm, val interface{}) (interface{}, error) {
+	val, err := v.storeValue(val, 0)
+	if err != nil {
+		return nil, err
+	}
+	return v.share(val), nil
+}
+
+func array(v *vm, items ...interface{}) ([]interface{}, error) {
+	res := make([]interface{}, len(items))
+	for i, item := range items {
+		item, err := v.storeValue(item, 1)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = v.share(item)
+	}
+	return v.own(res).([]interface{}), nil
+}
+
+// object creates object from list: key1, value1, key2, value2 ...
+func object(v *vm, keyValues ...interface{}) (interface{}, error) {
+	var res interface{} = make(map[string]interface{}, len(keyValues)/2)
+	if v.ordered {
+		res = NewOrderedMap()
+	}
+	for i := 0; i < len(keyValues); i += 2 {
+		key, err := jsonStringKey(keyValues[i])
+		if err != nil {
+			return nil, err
+		}
+		val, err := v.storeValue(keyValues[i+1], 1)
+		if err != nil {
+			return nil, err
+		}
+		objectSet(res, key, v.share(val))
+	}
+	return v.own(res), nil
+}
+
+// push appends item to array created by @array
+func push(v *vm, list []interface{}, item interface{}) ([]interface{}, error) {
+	item, err := v.storeValue(item, 1)
+	if err != nil {
+		return nil, err
+	}
+	list = v.writable(list).([]interface{})
+	return v.replace(list, append(list, v.share(item))).([]interface{}), nil
+}
+
+// put sets object key, object is created by @object
+func put(v *vm, obj, key, val interface{}) (interface{}, error) {
+	strKey, err := jsonStringKey(key)
+	if err != nil {
+		return nil, err
+	}
+	val, err = v.storeValue(val, 1)
+	if err != nil {
+		return nil, err
+	}
+	obj = v.writable(obj)
+	objectSet(obj, strKey, v.share(val))
+	return obj, nil
+}
+
+// objectSet sets key of map[string]interface{} or OrderedMap
+func objectSet(obj interface{}, key string, val interface{}) {
+	switch tv := obj.(type) {
+	case map[string]interface{}:
+		tv[key] = val
+	case *OrderedMap:
+		tv.Set(key, val)
+	}
+}
+
+// objectKeys returns keys of object, OrderedMap keys are in insertion order, other keys are sorted
+func objectKeys(obj interface{}) ([]string, bool) {
+	switch tv := obj.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(tv))
+		for key := range tv {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys, true
+	case *OrderedMap:
+		return tv.Keys(), true
+	}
+	return nil, false
+}
+
+func strTemplate(v *vm, t *template.Template, params interface{}) (string, error) {
+	params, err := v.plain(params)
+	if err != nil {
+		return "", err
+	}
 	buf := bytes.Buffer{}
-	err := t.Execute(&buf, params)
+	err = t.Execute(&buf, params)
 	if err != nil {
 		return "", err
 	}
-	return buf.String(), nil
+	res := buf.String()
+	return res, v.checkString(res)
+}
+
+// pathItem is path element which can match several values
+type pathItem int
+
+const (
+	pathAny  pathItem = iota //all children
+	pathDeep                 //node and all its descendants
+)
+
+func pathAnyItem() pathItem {
+	return pathAny
+}
+
+func pathDeepItem() pathItem {
+	return pathDeep
+}
+
+// pathSlice is path element which selects part of array, nil values mean default
+type pathSlice struct {
+	start, end, step *int
+}
+
+func newPathSlice(start, end, step interface{}) (pathSlice, error) {
+	var s pathSlice
+	for _, item := range []struct {
+		val interface{}
+		ptr **int
+	}{{start, &s.start}, {end, &s.end}, {step, &s.step}} {
+		if !isSet(item.val) {
+			continue
+		}
+		key, valid, err := jsonIntKey(item.val)
+		if err != nil {
+			return s, err
+		}
+		if !valid {
+			return s, fmt.Errorf("can`t use `%v` as slice index", item.val)
+		}
+		*item.ptr = &key
+	}
+	if s.step != nil && *s.step == 0 {
+		return s, errors.New("slice step can`t be zero")
+	}
+	return s, nil
+}
+
+// bounds returns slice bounds for array of length n, indexes are clamped the same way as in python
+func (s pathSlice) bounds(n int) (start, end, step int) {
+	step = 1
+	if s.step != nil {
+		step = *s.step
+	}
+	lower, upper := 0, n
+	if step < 0 {
+		lower, upper = -1, n-1
+	}
+	clamp := func(idx *int, def int) int {
+		if idx == nil {
+			return def
+		}
+		i := *idx
+		if i < 0 {
+			i += n
+		}
+		if i < lower {
+			return lower
+		}
+		if i > upper {
+			return upper
+		}
+		return i
+	}
+	if step > 0 {
+		return clamp(s.start, lower), clamp(s.end, upper), step
+	}
+	return clamp(s.start, upper), clamp(s.end, lower), step
+}
+
+func (s pathSlice) get(arr []interface{}) []interface{} {
+	start, end, step := s.bounds(len(arr))
+	res := []interface{}{}
+	for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		res = append(res, arr[i])
+	}
+	return res
+}
+
+// jsonSetSlice replaces part of array selected by slice with items of val
+func jsonSetSlice(v *vm, data, val interface{}, s pathSlice) (interface{}, error) {
+	if s.step != nil && *s.step != 1 {
+		return nil, errors.New("slice with step can`t be assigned")
+	}
+	data, err := v.jsonValue(data)
+	if err != nil {
+		return nil, err
+	}
+	var arr []interface{}
+	switch tv := data.(type) {
+	case nil, string, float64, int, bool:
+	case []interface{}:
+		arr = tv
+	default:
+		return nil, errors.New("slice can be assigned only to array")
+	}
+	val, err = v.materialize(val)
+	if err != nil {
+		return nil, err
+	}
+	val, err = v.jsonValue(val)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := val.([]interface{})
+	if !ok && val != nil {
+		return nil, errors.New("only array can be assigned to slice")
+	}
+	start, end, _ := s.bounds(len(arr))
+	if end < start {
+		end = start
+	}
+	res := make([]interface{}, 0, len(arr)-(end-start)+len(items))
+	res = append(res, arr[:start]...)
+	res = append(res, items...)
+	res = append(res, arr[end:]...)
+	for _, item := range res {
+		v.share(item)
+	}
+	return v.own(res), nil
 }
 
+// jsonGet returns value by path, if path contains pathItem then array of all matched values is returned
 func jsonGet(val interface{}, path ...interface{}) (interface{}, error) {
-	if len(path) == 0 {
-		return val, nil
+	nodes := []interface{}{val}
+	multi := false
+	for _, key := range path {
+		var next []interface{}
+		switch key {
+		case pathAny:
+			multi = true
+			for _, node := range nodes {
+				children, err := jsonChildren(node)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, children...)
+			}
+		case pathDeep:
+			multi = true
+			for _, node := range nodes {
+				var err error
+				next, err = jsonDescendants(next, node)
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			for _, node := range nodes {
+				if s, ok := key.(pathSlice); ok {
+					arr, err := jsonValue(node)
+					if err != nil {
+						return nil, err
+					}
+					if tv, ok := arr.([]interface{}); ok {
+						next = append(next, s.get(tv))
+					} else if !multi {
+						next = append(next, nil)
+					}
+					continue
+				}
+				child, found, err := jsonChild(node, key)
+				if err != nil {
+					return nil, err
+				}
+				if found || !multi {
+					next = append(next, child)
+				}
+			}
+		}
+		nodes = next
+	}
+	if multi {
+		return append([]interface{}{}, nodes...), nil
 	}
+	return nodes[0], nil
+}
+
+// jsonChild returns value by key, second value is false if key is not found
+func jsonChild(val, key interface{}) (interface{}, bool, error) {
 	switch tv := val.(type) {
 	case nil, string, float64, int, bool:
-		return nil, nil
+		return nil, false, nil
 	case map[string]interface{}:
-		key, err := jsonStringKey(path[0])
+		key, err := jsonStringKey(key)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return jsonGet(tv[key], path[1:]...)
+		v, found := tv[key]
+		return v, found, nil
 	case []interface{}:
-		key, valid, err := jsonIntKey(path[0])
+		key, valid, err := jsonIntKey(key)
 		if err != nil {
-			return nil, err
+			return nil, false, err
+		}
+		if key < 0 {
+			key += len(tv)
 		}
 		if !valid || key < 0 || key >= len(tv) {
-			return nil, nil
+			return nil, false, nil
+		}
+		return tv[key], true, nil
+	case *OrderedMap:
+		key, err := jsonStringKey(key)
+		if err != nil {
+			return nil, false, err
+		}
+		v, found := tv.Get(key)
+		return v, found, nil
+	case *numRange:
+		key, valid, err := jsonIntKey(key)
+		if err != nil {
+			return nil, false, err
+		}
+		n := tv.len()
+		if key < 0 {
+			key += n
+		}
+		if !valid || key < 0 || key >= n {
+			return nil, false, nil
 		}
-		return jsonGet(tv[key], path[1:]...)
+		src := tv.source()
+		src.cur = key
+		return src.value(), true, nil
+	case json.RawMessage:
+		return jsonRawChild(tv, key)
 	}
 
 	//todo: optimization
-	d, err := json.Marshal(val)
+	v, err := jsonValue(val)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	return jsonChild(v, key)
+}
+
+// jsonRawChild returns value by key from json document, nested objects are kept as json to keep order of keys
+func jsonRawChild(data json.RawMessage, key interface{}) (interface{}, bool, error) {
+	data = bytes.TrimSpace(data)
+	var child json.RawMessage
+	found := false
+	switch {
+	case len(data) > 0 && data[0] == '{':
+		var obj map[string]json.RawMessage
+		err := json.Unmarshal(data, &obj)
+		if err != nil {
+			return nil, false, err
+		}
+		strKey, err := jsonStringKey(key)
+		if err != nil {
+			return nil, false, err
+		}
+		child, found = obj[strKey]
+	case len(data) > 0 && data[0] == '[':
+		var arr []json.RawMessage
+		err := json.Unmarshal(data, &arr)
+		if err != nil {
+			return nil, false, err
+		}
+		intKey, valid, err := jsonIntKey(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if intKey < 0 {
+			intKey += len(arr)
+		}
+		if valid && intKey >= 0 && intKey < len(arr) {
+			child, found = arr[intKey], true
+		}
+	default:
+		return nil, false, nil
 	}
+	if !found {
+		return nil, false, nil
+	}
+	v, err := rawValue(child)
+	return v, err == nil, err
+}
 
+// rawValue decodes json, objects and arrays are kept as json to keep order of keys
+func rawValue(data json.RawMessage) (interface{}, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && (data[0] == '{' || data[0] == '[') {
+		return data, nil
+	}
 	var v interface{}
-	err = json.Unmarshal(d, &v)
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// jsonChildren returns array elements or object values in iteration order
+func jsonChildren(val interface{}) ([]interface{}, error) {
+	switch tv := val.(type) {
+	case nil, string, float64, int, bool:
+		return nil, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(tv))
+		for key := range tv {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		res := make([]interface{}, len(keys))
+		for i, key := range keys {
+			res[i] = tv[key]
+		}
+		return res, nil
+	case *OrderedMap:
+		res := make([]interface{}, len(tv.keys))
+		for i, key := range tv.keys {
+			res[i] = tv.values[key]
+		}
+		return res, nil
+	case []interface{}:
+		return tv, nil
+	case json.RawMessage:
+		data := bytes.TrimSpace(tv)
+		if len(data) > 0 && (data[0] == '{' || data[0] == '[') {
+			//keep order of keys from document
+			items, err := decodeItems(data)
+			if err != nil {
+				return nil, err
+			}
+			return items.values, nil
+		}
+	}
+
+	v, err := jsonValue(val)
+	if err != nil {
+		return nil, err
+	}
+	return jsonChildren(v)
+}
+
+// jsonDescendants appends val and all nested values to res
+func jsonDescendants(res []interface{}, val interface{}) ([]interface{}, error) {
+	res = append(res, val)
+	children, err := jsonChildren(val)
 	if err != nil {
 		return nil, err
 	}
-	return jsonGet(v, path...)
+	for _, child := range children {
+		res, err = jsonDescendants(res, child)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
 }
 
 func jsonStringKey(v interface{}) (string, error) {
@@ -135,23 +589,63 @@ func jsonIntKey(v interface{}) (int, bool, error) {
 	return key, true, nil
 }
 
-func jsonSet(data, val interface{}, path ...interface{}) (interface{}, error) {
+func jsonSet(v *vm, data, val interface{}, path ...interface{}) (interface{}, error) {
+	val, err := v.storeValue(val, len(path))
+	if err != nil {
+		return nil, err
+	}
+	return jsonChange(v, data, path, func(interface{}) (interface{}, error) {
+		return v.share(val), nil
+	})
+}
+
+// jsonChange replaces value by path with result of change function,
+// containers on the path are copied if they can't be changed in place
+func jsonChange(v *vm, data interface{}, path []interface{}, change func(cur interface{}) (interface{}, error)) (interface{}, error) {
 	if len(path) == 0 {
-		return val, nil
+		return change(data)
+	}
+	if s, ok := path[0].(pathSlice); ok {
+		data, err := v.jsonValue(data)
+		if err != nil {
+			return nil, err
+		}
+		arr, _ := data.([]interface{})
+		items, err := change(s.get(arr))
+		if err != nil {
+			return nil, err
+		}
+		return jsonSetSlice(v, data, items, s)
 	}
 	switch vData := data.(type) {
 	case nil, string, float64, int, bool:
-		return jsonNew(val, path...)
+		return jsonNew(v, path, change)
 	case map[string]interface{}:
 		key, err := jsonStringKey(path[0])
 		if err != nil {
 			return nil, err
 		}
-		v, err := jsonSet(vData[key], val, path[1:]...)
+		vData = v.writable(vData).(map[string]interface{})
+		item, err := jsonChange(v, vData[key], path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		v.drop(vData[key], item)
+		vData[key] = item
+		return vData, nil
+	case *OrderedMap:
+		key, err := jsonStringKey(path[0])
+		if err != nil {
+			return nil, err
+		}
+		vData = v.writable(vData).(*OrderedMap)
+		cur, _ := vData.Get(key)
+		item, err := jsonChange(v, cur, path[1:], change)
 		if err != nil {
 			return nil, err
 		}
-		vData[key] = v
+		v.drop(cur, item)
+		vData.Set(key, item)
 		return vData, nil
 	case []interface{}:
 		key, valid, err := jsonIntKey(path[0])
@@ -162,145 +656,403 @@ func jsonSet(data, val interface{}, path ...interface{}) (interface{}, error) {
 			return nil, fmt.Errorf("can`t use `%v` as array index", path[0])
 		}
 		if key >= len(vData) {
-			v, err := jsonNew(val, path[1:]...)
+			err = v.checkGap(key - len(vData))
+			if err != nil {
+				return nil, err
+			}
+			item, err := jsonNew(v, path[1:], change)
 			if err != nil {
 				return nil, err
 			}
-			extend := make([]interface{}, len(vData)+1-key)
-			extend[len(extend)-1] = v
-			return append(vData, extend...), nil
+			extend := make([]interface{}, key+1-len(vData))
+			extend[len(extend)-1] = item
+			vData = v.writable(vData).([]interface{})
+			return v.replace(vData, append(vData, extend...)), nil
 		}
 		if key >= -len(vData) {
 			if key < 0 {
 				key = len(vData) + key
 			}
-			v, err := jsonSet(vData[key], val, path[1:]...)
+			vData = v.writable(vData).([]interface{})
+			item, err := jsonChange(v, vData[key], path[1:], change)
 			if err != nil {
 				return nil, err
 			}
-			vData[key] = v
+			v.drop(vData[key], item)
+			vData[key] = item
 			return vData, nil
 		}
 
-		v, err := jsonNew(val, path[1:]...)
+		err = v.checkGap(-len(vData) - key - 1)
+		if err != nil {
+			return nil, err
+		}
+		item, err := jsonNew(v, path[1:], change)
 		if err != nil {
 			return nil, err
 		}
 		prepend := make([]interface{}, -len(vData)-key)
-		prepend[0] = v
-		return append(prepend, vData...), nil
+		prepend[0] = item
+		for _, item := range vData {
+			v.share(item)
+		}
+		return v.own(append(prepend, vData...)), nil
 	}
 
 	//todo: optimization
-	d, err := json.Marshal(data)
-	if err != nil {
-		return nil, err
-	}
-
-	var v interface{}
-	err = json.Unmarshal(d, &v)
+	data, err := v.jsonValue(data)
 	if err != nil {
 		return nil, err
 	}
-	return jsonSet(v, val, path...)
+	return jsonChange(v, data, path, change)
 }
 
-func jsonNew(val interface{}, path ...interface{}) (interface{}, error) {
+// jsonDelete removes value by path, array elements after removed one are shifted
+func jsonDelete(v *vm, data interface{}, path ...interface{}) (interface{}, error) {
 	if len(path) == 0 {
-		return val, nil
+		return nil, nil
 	}
-	switch path[0].(type) {
-	case int, float64:
+	if s, ok := path[0].(pathSlice); ok {
+		return jsonSetSlice(v, data, nil, s)
+	}
+	switch vData := data.(type) {
+	case nil, string, float64, int, bool:
+		return data, nil
+	case map[string]interface{}:
+		key, err := jsonStringKey(path[0])
+		if err != nil {
+			return nil, err
+		}
+		item, isSet := vData[key]
+		if !isSet {
+			return vData, nil
+		}
+		vData = v.writable(vData).(map[string]interface{})
+		if len(path) == 1 {
+			v.release(vData[key])
+			delete(vData, key)
+			return vData, nil
+		}
+		item, err = jsonDelete(v, vData[key], path[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		v.drop(vData[key], item)
+		vData[key] = item
+		return vData, nil
+	case *OrderedMap:
+		key, err := jsonStringKey(path[0])
+		if err != nil {
+			return nil, err
+		}
+		item, isSet := vData.Get(key)
+		if !isSet {
+			return vData, nil
+		}
+		vData = v.writable(vData).(*OrderedMap)
+		if len(path) == 1 {
+			v.release(item)
+			vData.Delete(key)
+			return vData, nil
+		}
+		cur := item
+		item, err = jsonDelete(v, cur, path[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		v.drop(cur, item)
+		vData.Set(key, item)
+		return vData, nil
+	case []interface{}:
 		key, valid, err := jsonIntKey(path[0])
 		if err != nil {
 			return nil, err
 		}
-		if valid && key >= 0 {
-			data := make([]interface{}, key+1)
-			data[key], err = jsonNew(val, path[1:]...)
-			if err != nil {
-				return nil, err
-			}
-			return data, nil
+		if !valid {
+			return nil, fmt.Errorf("can`t use `%v` as array index", path[0])
+		}
+		if key < 0 {
+			key = len(vData) + key
+		}
+		if key < 0 || key >= len(vData) {
+			return vData, nil
 		}
+		vData = v.writable(vData).([]interface{})
+		if len(path) == 1 {
+			v.release(vData[key])
+			return append(vData[:key], vData[key+1:]...), nil
+		}
+		item, err := jsonDelete(v, vData[key], path[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		v.drop(vData[key], item)
+		vData[key] = item
+		return vData, nil
 	}
 
-	key, err := jsonStringKey(path[0])
-	if err != nil {
-		return nil, err
-	}
-	data, err := jsonNew(val, path[1:]...)
+	data, err := v.jsonValue(data)
 	if err != nil {
 		return nil, err
 	}
-	return map[string]interface{}{key: data}, nil
+	return jsonDelete(v, data, path...)
 }
 
-func jsonAppend(data, val interface{}, path ...interface{}) (interface{}, error) {
-	if len(path) == 0 {
-		return jsonAppendCur(data, val)
-	}
-	lastNode, err := jsonGet(data, path...)
+// jsonMerge deep merges val into data: objects are merged recursively, arrays are concatenated,
+// other values are replaced with val
+func jsonMerge(v *vm, data, val interface{}, path ...interface{}) (interface{}, error) {
+	val, err := v.storeValue(val, len(path))
 	if err != nil {
 		return nil, err
 	}
-	lastNode, err = jsonAppendCur(lastNode, val)
+	val, err = clone(val)
 	if err != nil {
 		return nil, err
 	}
-	data, err = jsonSet(data, lastNode, path...)
+	val, err = v.jsonValue(val)
 	if err != nil {
 		return nil, err
 	}
-	return data, nil
+	return jsonChange(v, data, path, func(cur interface{}) (interface{}, error) {
+		return jsonMergeCur(v, cur, val)
+	})
 }
 
-func jsonAppendCur(data, val interface{}) (interface{}, error) {
-	switch tv := data.(type) {
-	case nil, string, float64, int, bool:
-		return []interface{}{val}, nil
-	case map[string]interface{}:
-		i := 0
-		_, isSet := tv[strconv.Itoa(i)]
+func jsonMergeCur(v *vm, data, val interface{}) (interface{}, error) {
+	data, err := v.jsonValue(data)
+	if err != nil {
+		return nil, err
+	}
+	switch vData := data.(type) {
+	case map[string]interface{}, *OrderedMap:
+		keys, ok := objectKeys(val)
+		if !ok {
+			return val, nil
+		}
+		data = v.writable(vData)
+		for _, key := range keys {
+			item, _, _ := jsonChild(val, key)
+			cur, _, _ := jsonChild(data, key)
+			item, err = jsonMergeCur(v, cur, item)
+			if err != nil {
+				return nil, err
+			}
+			v.drop(cur, item)
+			objectSet(data, key, item)
+		}
+		return data, nil
+	case []interface{}:
+		vVal, ok := val.([]interface{})
+		if !ok {
+			return val, nil
+		}
+		vData = v.writable(vData).([]interface{})
+		return v.replace(vData, append(vData, vVal...)), nil
+	}
+	return val, nil
+}
+
+// jsonNew creates containers for path, value at the end of path is result of change function
+func jsonNew(v *vm, path []interface{}, change func(cur interface{}) (interface{}, error)) (interface{}, error) {
+	if len(path) == 0 {
+		return change(nil)
+	}
+	if s, ok := path[0].(pathSlice); ok {
+		items, err := change(s.get(nil))
+		if err != nil {
+			return nil, err
+		}
+		return jsonSetSlice(v, nil, items, s)
+	}
+	switch path[0].(type) {
+	case int, float64:
+		key, valid, err := jsonIntKey(path[0])
+		if err != nil {
+			return nil, err
+		}
+		if valid && key >= 0 {
+			err = v.checkGap(key)
+			if err != nil {
+				return nil, err
+			}
+			data := make([]interface{}, key+1)
+			data[key], err = jsonNew(v, path[1:], change)
+			if err != nil {
+				return nil, err
+			}
+			return v.own(data), nil
+		}
+	}
+
+	key, err := jsonStringKey(path[0])
+	if err != nil {
+		return nil, err
+	}
+	data, err := jsonNew(v, path[1:], change)
+	if err != nil {
+		return nil, err
+	}
+	if v.ordered {
+		obj := NewOrderedMap()
+		obj.Set(key, data)
+		return v.own(obj), nil
+	}
+	return v.own(map[string]interface{}{key: data}), nil
+}
+
+func jsonAppend(v *vm, data, val interface{}, path ...interface{}) (interface{}, error) {
+	val, err := v.storeValue(val, len(path)+1)
+	if err != nil {
+		return nil, err
+	}
+	return jsonChange(v, data, path, func(cur interface{}) (interface{}, error) {
+		return jsonAppendCur(v, cur, v.share(val))
+	})
+}
+
+func jsonAppendCur(v *vm, data, val interface{}) (interface{}, error) {
+	switch tv := data.(type) {
+	case nil, string, float64, int, bool:
+		return v.own([]interface{}{val}), nil
+	case map[string]interface{}:
+		tv = v.writable(tv).(map[string]interface{})
+		i := 0
+		_, isSet := tv[strconv.Itoa(i)]
 		for isSet {
 			i++
 			_, isSet = tv[strconv.Itoa(i)]
 		}
 		tv[strconv.Itoa(i)] = val
 		return tv, nil
+	case *OrderedMap:
+		tv = v.writable(tv).(*OrderedMap)
+		i := 0
+		_, isSet := tv.Get(strconv.Itoa(i))
+		for isSet {
+			i++
+			_, isSet = tv.Get(strconv.Itoa(i))
+		}
+		tv.Set(strconv.Itoa(i), val)
+		return tv, nil
 	case []interface{}:
-		return append(tv, val), nil
+		tv = v.writable(tv).([]interface{})
+		return v.replace(tv, append(tv, val)), nil
 	}
 
-	d, err := json.Marshal(val)
+	data, err := v.jsonValue(data)
 	if err != nil {
 		return nil, err
 	}
-
-	var v interface{}
-	err = json.Unmarshal(d, &v)
-
-	return jsonAppendCur(v, val)
+	return jsonAppendCur(v, data, val)
 }
 
 type iterator struct {
 	withKey, withVal bool
-	cur, len         int
-	keys             []interface{}
-	values           []interface{}
+	src              iteratorSource
+}
+
+// iteratorSource walks collection lazily
+type iteratorSource interface {
+	next() bool
+	key() interface{}
+	value() interface{}
+}
+
+type emptySource struct{}
+
+func (emptySource) next() bool         { return false }
+func (emptySource) key() interface{}   { return nil }
+func (emptySource) value() interface{} { return nil }
+
+type sliceSource struct {
+	rv  reflect.Value
+	cur int
+}
+
+func (s *sliceSource) next() bool {
+	s.cur++
+	return s.cur < s.rv.Len()
+}
+
+func (s *sliceSource) key() interface{} {
+	return s.cur
+}
+
+func (s *sliceSource) value() interface{} {
+	return s.rv.Index(s.cur).Interface()
+}
+
+// mapSource walks map in sorted key order
+type mapSource struct {
+	rv   reflect.Value
+	keys []reflect.Value
+	cur  int
+}
+
+func newMapSource(rv reflect.Value) *mapSource {
+	keys := rv.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return mapKeyLess(keys[i], keys[j])
+	})
+	return &mapSource{rv: rv, keys: keys, cur: -1}
+}
+
+func mapKeyLess(k1, k2 reflect.Value) bool {
+	switch k1.Kind() {
+	case reflect.String:
+		return k1.String() < k2.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return k1.Int() < k2.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return k1.Uint() < k2.Uint()
+	case reflect.Float32, reflect.Float64:
+		return k1.Float() < k2.Float()
+	}
+	return fmt.Sprint(k1.Interface()) < fmt.Sprint(k2.Interface())
+}
+
+func (s *mapSource) next() bool {
+	s.cur++
+	return s.cur < len(s.keys)
+}
+
+func (s *mapSource) key() interface{} {
+	return s.keys[s.cur].Interface()
+}
+
+func (s *mapSource) value() interface{} {
+	return s.rv.MapIndex(s.keys[s.cur]).Interface()
 }
 
 func (i *iterator) init(data interface{}) error {
-	i.cur = -1
-	i.len = 0
-	rm, ok := data.(json.RawMessage)
-	if ok {
+	i.src = emptySource{}
+	switch tv := data.(type) {
+	case json.RawMessage:
+		data := bytes.TrimSpace(tv)
+		if len(data) > 0 && (data[0] == '{' || data[0] == '[') {
+			//keep order of keys from document
+			items, err := decodeItems(data)
+			if err != nil {
+				return err
+			}
+			i.src = items.source()
+			return nil
+		}
 		var v interface{}
-		err := json.Unmarshal(rm, &v)
+		err := json.Unmarshal(tv, &v)
 		if err != nil {
 			return err
 		}
 		return i.init(v)
+	case *numRange:
+		i.src = tv.source()
+		return nil
+	case *orderedItems:
+		i.src = tv.source()
+		return nil
+	case *OrderedMap:
+		i.src = tv.items().source()
+		return nil
 	}
 	rv := reflect.ValueOf(data)
 	switch rv.Kind() {
@@ -316,30 +1068,11 @@ func (i *iterator) init(data interface{}) error {
 		}
 		return i.init(v)
 	case reflect.Slice, reflect.Array:
-		i.len = rv.Len()
-		for key := 0; key < i.len; key++ {
-			if i.withKey {
-				i.keys = append(i.keys, key)
-			}
-			if i.withVal {
-				i.values = append(i.values, rv.Index(key).Interface())
-			}
-		}
+		i.src = &sliceSource{rv: rv, cur: -1}
 	case reflect.Map:
-		rKeys := rv.MapKeys()
-		i.len = rv.Len()
-		for _, rKey := range rKeys {
-			if i.withKey {
-				i.keys = append(i.keys, rKey.Interface())
-			}
-			if i.withVal {
-				i.values = append(i.values, rv.MapIndex(rKey).Interface())
-			}
-		}
+		i.src = newMapSource(rv)
 	case reflect.Chan:
-		errors.New("foreach by chan not supported")
-	default:
-		return nil
+		return errors.New("foreach by chan not supported")
 	}
 	return nil
 }
@@ -370,55 +1103,473 @@ func initIteratorKV(data interface{}) (*iterator, error) {
 }
 
 func iteratorStep(i *iterator) bool {
-	i.cur++
-	return i.cur < i.len
+	return i.src.next()
 }
 
 func iteratorKey(i *iterator) interface{} {
 	if !i.withKey {
 		return nil
 	}
-	return i.keys[i.cur]
+	return i.src.key()
 }
 
-func iteratorValue(i *iterator) interface{} {
+func iteratorValue(v *vm, i *iterator) interface{} {
 	if !i.withVal {
 		return nil
 	}
-	return i.values[i.cur]
+	return v.share(i.src.value())
 }
 
-func eq(v1, v2 interface{}) (bool, error) {
-	var err error
-	jr, ok := v1.(json.RawMessage)
-	if ok {
-		err = json.Unmarshal(jr, &v1)
+// numRange is lazy sequence of numbers created by `range` function
+type numRange struct {
+	start, end, step float64
+	isInt            bool
+}
+
+func newRange(args ...interface{}) (*numRange, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return nil, fmt.Errorf("wrong number of args for range: want 1-3 got %d", len(args))
+	}
+	nums := make([]float64, len(args))
+	isInt := true
+	for i, arg := range args {
+		n, ok := jsonNumber(arg)
+		if !ok {
+			return nil, fmt.Errorf("range arg %d is not numeric", i+1)
+		}
+		nums[i] = toFloat(n)
+		isInt = isInt && nums[i] == math.Trunc(nums[i])
+	}
+	r := &numRange{step: 1, isInt: isInt}
+	switch len(nums) {
+	case 1:
+		r.end = nums[0]
+	case 3:
+		r.step = nums[2]
+		fallthrough
+	case 2:
+		r.start, r.end = nums[0], nums[1]
+	}
+	if r.step == 0 {
+		return nil, errors.New("range step can`t be zero")
+	}
+	return r, nil
+}
+
+func (r *numRange) source() *rangeSource {
+	return &rangeSource{r: r, cur: -1}
+}
+
+// len returns number of range items
+func (r *numRange) len() int {
+	n := math.Ceil((r.end - r.start) / r.step)
+	if n <= 0 {
+		return 0
+	}
+	if n > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(n)
+}
+
+// MarshalJSON materialises range as array
+func (r *numRange) MarshalJSON() ([]byte, error) {
+	items := []interface{}{}
+	src := r.source()
+	for src.next() {
+		items = append(items, src.value())
+	}
+	return json.Marshal(items)
+}
+
+type rangeSource struct {
+	r   *numRange
+	cur int
+}
+
+func (s *rangeSource) num() float64 {
+	return s.r.start + float64(s.cur)*s.r.step
+}
+
+func (s *rangeSource) next() bool {
+	s.cur++
+	n := s.num()
+	if s.r.step > 0 {
+		return n < s.r.end
+	}
+	return n > s.r.end
+}
+
+// key of range item is the same as value, so `for i in range(...)` iterates numbers
+func (s *rangeSource) key() interface{} {
+	return s.value()
+}
+
+func (s *rangeSource) value() interface{} {
+	if s.r.isInt {
+		return int(s.num())
+	}
+	return s.num()
+}
+
+// orderedItems is array or object with items in the given order,
+// it is created by `sorted`, `sortBy` and for iteration of json object in document order
+type orderedItems struct {
+	isObject bool
+	keys     []string
+	values   []interface{}
+}
+
+// decodeItems decodes json object or array keeping order of keys
+func decodeItems(data []byte) (*orderedItems, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	items := &orderedItems{isObject: t == json.Delim('{')}
+	key2Id := map[string]int{}
+	for dec.More() {
+		var key string
+		if items.isObject {
+			t, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ = t.(string)
+		}
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
 		if err != nil {
-			return false, err
+			return nil, err
+		}
+		val, err := rawValue(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !items.isObject {
+			items.values = append(items.values, val)
+			continue
+		}
+		if id, ok := key2Id[key]; ok {
+			items.values[id] = val
+			continue
 		}
+		key2Id[key] = len(items.keys)
+		items.keys = append(items.keys, key)
+		items.values = append(items.values, val)
 	}
-	jr, ok = v2.(json.RawMessage)
-	if ok {
-		err := json.Unmarshal(jr, &v2)
+	return items, nil
+}
+
+// newOrderedItems collects keys and values of collection in iteration order
+func newOrderedItems(v *vm, data interface{}) (*orderedItems, error) {
+	data, err := v.materialize(data)
+	if err != nil {
+		return nil, err
+	}
+	i := iterator{withKey: true, withVal: true}
+	err = i.init(data)
+	if err != nil {
+		return nil, err
+	}
+	items := &orderedItems{}
+	switch src := i.src.(type) {
+	case *mapSource:
+		items.isObject = true
+	case *orderedSource:
+		items.isObject = src.items.isObject
+	}
+	for i.src.next() {
+		if items.isObject {
+			key, err := jsonStringKey(i.src.key())
+			if err != nil {
+				key = fmt.Sprint(i.src.key())
+			}
+			items.keys = append(items.keys, key)
+		}
+		items.values = append(items.values, i.src.value())
+	}
+	return items, nil
+}
+
+// sort orders items with less function of indexes, desc reverses order
+func (o *orderedItems) sort(less func(i, j int) bool, desc []interface{}) (*orderedItems, error) {
+	if len(desc) > 1 {
+		return nil, fmt.Errorf("wrong number of args: want at most one `desc` flag got %d", len(desc))
+	}
+	isDesc := len(desc) > 0 && toBool(desc[0])
+	idx := make([]int, len(o.values))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		if isDesc {
+			return less(idx[j], idx[i])
+		}
+		return less(idx[i], idx[j])
+	})
+	res := &orderedItems{isObject: o.isObject, values: make([]interface{}, len(idx))}
+	if o.isObject {
+		res.keys = make([]string, len(idx))
+	}
+	for i, id := range idx {
+		res.values[i] = o.values[id]
+		if o.isObject {
+			res.keys[i] = o.keys[id]
+		}
+	}
+	return res, nil
+}
+
+// sorted orders array by values or object by keys
+func sorted(v *vm, data interface{}, desc ...interface{}) (*orderedItems, error) {
+	items, err := newOrderedItems(v, data)
+	if err != nil {
+		return nil, err
+	}
+	if items.isObject {
+		return items.sort(func(i, j int) bool {
+			return items.keys[i] < items.keys[j]
+		}, desc)
+	}
+	return items.sort(func(i, j int) bool {
+		return sortCompare(items.values[i], items.values[j]) < 0
+	}, desc)
+}
+
+// sortBy orders array or object items by value of item key
+func sortBy(v *vm, data, key interface{}, desc ...interface{}) (*orderedItems, error) {
+	items, err := newOrderedItems(v, data)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]interface{}, len(items.values))
+	for i, item := range items.values {
+		fields[i], err = jsonGet(item, key)
 		if err != nil {
-			return false, err
+			return nil, err
+		}
+	}
+	return items.sort(func(i, j int) bool {
+		return sortCompare(fields[i], fields[j]) < 0
+	}, desc)
+}
+
+// sortCompare compares any json values: null < bool < number < string < array and object
+func sortCompare(v1, v2 interface{}) int {
+	v1, _ = jsonValue(v1)
+	v2, _ = jsonValue(v2)
+	r1, r2 := sortRank(v1), sortRank(v2)
+	if r1 != r2 {
+		return r1 - r2
+	}
+	switch tv := v1.(type) {
+	case bool:
+		if tv == v2.(bool) {
+			return 0
+		}
+		if tv {
+			return 1
+		}
+		return -1
+	case string:
+		return strings.Compare(tv, v2.(string))
+	}
+	if r1 == 2 {
+		return compareNumbers(v1, v2)
+	}
+	return 0
+}
+
+func sortRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case int, float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+func (o *orderedItems) source() *orderedSource {
+	return &orderedSource{items: o, cur: -1}
+}
+
+// MarshalJSON writes items in their order
+func (o *orderedItems) MarshalJSON() ([]byte, error) {
+	if !o.isObject {
+		if o.values == nil {
+			return []byte("[]"), nil
 		}
+		return json.Marshal(o.values)
 	}
-	rv1 := reflect.ValueOf(v1)
-	rv2 := reflect.ValueOf(v2)
-	if rv1.Type() == rv2.Type() {
-		return reflect.DeepEqual(rv1, rv2), nil
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
 	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type orderedSource struct {
+	items *orderedItems
+	cur   int
+}
+
+func (s *orderedSource) next() bool {
+	s.cur++
+	return s.cur < len(s.items.values)
+}
 
-	err = marshalUnmarshal(v1, &v1)
+func (s *orderedSource) key() interface{} {
+	if s.items.isObject {
+		return s.items.keys[s.cur]
+	}
+	return s.cur
+}
+
+func (s *orderedSource) value() interface{} {
+	return s.items.values[s.cur]
+}
+
+func eq(v1, v2 interface{}) (bool, error) {
+	var err error
+	v1, err = jsonValue(v1)
 	if err != nil {
 		return false, err
 	}
-	err = marshalUnmarshal(v2, &v2)
+	v2, err = jsonValue(v2)
 	if err != nil {
 		return false, err
 	}
-	return reflect.DeepEqual(rv1, rv2), nil
+	return jsonEqual(v1, v2), nil
+}
+
+// jsonValue converts v to one of the types produced by json.Unmarshal, keeping int as is
+func jsonValue(v interface{}) (interface{}, error) {
+	switch tv := v.(type) {
+	case nil, string, float64, int, bool, map[string]interface{}, []interface{}:
+		return v, nil
+	case json.RawMessage:
+		var res interface{}
+		err := json.Unmarshal(tv, &res)
+		return res, err
+	}
+	if n, ok := jsonNumber(v); ok {
+		return n, nil
+	}
+	var res interface{}
+	err := marshalUnmarshal(v, &res)
+	return res, err
+}
+
+func jsonEqual(v1, v2 interface{}) bool {
+	n1, ok1 := jsonNumber(v1)
+	n2, ok2 := jsonNumber(v2)
+	if ok1 && ok2 {
+		return compareNumbers(n1, n2) == 0
+	}
+	switch tv1 := v1.(type) {
+	case []interface{}:
+		tv2, ok := v2.([]interface{})
+		if !ok || len(tv1) != len(tv2) {
+			return false
+		}
+		for i := range tv1 {
+			if !jsonEqual(tv1[i], tv2[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		tv2, ok := v2.(map[string]interface{})
+		if !ok || len(tv1) != len(tv2) {
+			return false
+		}
+		for key, val := range tv1 {
+			val2, ok := tv2[key]
+			if !ok || !jsonEqual(val, val2) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(v1, v2)
+}
+
+// jsonNumber returns v as int or float64, second value is false if v is not numeric
+func jsonNumber(v interface{}) (interface{}, bool) {
+	switch tv := v.(type) {
+	case int, float64:
+		return v, true
+	case json.RawMessage:
+		var f float64
+		err := json.Unmarshal(tv, &f)
+		if err != nil {
+			return nil, false
+		}
+		return f, true
+	case nil:
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return nil, false
+}
+
+func toFloat(n interface{}) float64 {
+	if i, ok := n.(int); ok {
+		return float64(i)
+	}
+	return n.(float64)
+}
+
+func compareNumbers(n1, n2 interface{}) int {
+	i1, ok1 := n1.(int)
+	i2, ok2 := n2.(int)
+	if ok1 && ok2 {
+		switch {
+		case i1 < i2:
+			return -1
+		case i1 > i2:
+			return 1
+		}
+		return 0
+	}
+	f1, f2 := toFloat(n1), toFloat(n2)
+	switch {
+	case f1 < f2:
+		return -1
+	case f1 > f2:
+		return 1
+	}
+	return 0
 }
 
 func marshalUnmarshal(in interface{}, out interface{}) error {
@@ -494,3 +1645,272 @@ func and(list ...interface{}) bool {
 func not(v interface{}) bool {
 	return isEmpty(reflect.ValueOf(v))
 }
+
+func toBool(v interface{}) bool {
+	return !isEmpty(reflect.ValueOf(v))
+}
+
+// fail raises TemplateError, position is set by vm
+func fail(code, message interface{}, data ...interface{}) (interface{}, error) {
+	tErr := TemplateError{}
+	var err error
+	tErr.Code, err = jsonStringKey(code)
+	if err != nil {
+		return nil, err
+	}
+	tErr.Message, err = jsonStringKey(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		tErr.Data, err = clone(data[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, tErr
+}
+
+func value(v interface{}) interface{} {
+	return v
+}
+
+// isSet returns false for missing and null values
+func isSet(v interface{}) bool {
+	switch tv := v.(type) {
+	case nil:
+		return false
+	case json.RawMessage:
+		return len(bytes.TrimSpace(tv)) > 0 && string(bytes.TrimSpace(tv)) != "null"
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return !rv.IsNil()
+	}
+	return true
+}
+
+// defaultValue returns fallback if v is missing or null
+func defaultValue(v, fallback interface{}) interface{} {
+	if isSet(v) {
+		return v
+	}
+	return fallback
+}
+
+// numericArgs converts both operands to numbers, allInt is true if both are int
+func numericArgs(op string, v1, v2 interface{}) (n1, n2 interface{}, allInt bool, err error) {
+	var ok bool
+	n1, ok = jsonNumber(v1)
+	if !ok {
+		return nil, nil, false, fmt.Errorf("first operand of `%s` is not numeric", op)
+	}
+	n2, ok = jsonNumber(v2)
+	if !ok {
+		return nil, nil, false, fmt.Errorf("second operand of `%s` is not numeric", op)
+	}
+	_, ok1 := n1.(int)
+	_, ok2 := n2.(int)
+	return n1, n2, ok1 && ok2, nil
+}
+
+func add(v *vm, v1, v2 interface{}) (interface{}, error) {
+	s1, ok1 := jsonString(v1)
+	s2, ok2 := jsonString(v2)
+	if ok1 || ok2 {
+		if !ok1 {
+			s1, ok1 = jsonScalarString(v1)
+		}
+		if !ok2 {
+			s2, ok2 = jsonScalarString(v2)
+		}
+		if !ok1 || !ok2 {
+			return nil, errors.New("only scalar values can be concatenated with string")
+		}
+		res := s1 + s2
+		return res, v.checkString(res)
+	}
+
+	n1, n2, allInt, err := numericArgs("+", v1, v2)
+	if err != nil {
+		return nil, err
+	}
+	if allInt {
+		return n1.(int) + n2.(int), nil
+	}
+	return toFloat(n1) + toFloat(n2), nil
+}
+
+// jsonString returns v as string if v is string value
+func jsonString(v interface{}) (string, bool) {
+	switch tv := v.(type) {
+	case string:
+		return tv, true
+	case json.RawMessage:
+		var s string
+		err := json.Unmarshal(tv, &s)
+		return s, err == nil
+	}
+	return "", false
+}
+
+func jsonScalarString(v interface{}) (string, bool) {
+	if n, ok := jsonNumber(v); ok {
+		return fmt.Sprint(n), true
+	}
+	v, err := jsonValue(v)
+	if err != nil {
+		return "", false
+	}
+	switch tv := v.(type) {
+	case bool:
+		return strconv.FormatBool(tv), true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
+
+func sub(v1, v2 interface{}) (interface{}, error) {
+	n1, n2, allInt, err := numericArgs("-", v1, v2)
+	if err != nil {
+		return nil, err
+	}
+	if allInt {
+		return n1.(int) - n2.(int), nil
+	}
+	return toFloat(n1) - toFloat(n2), nil
+}
+
+func mul(v1, v2 interface{}) (interface{}, error) {
+	n1, n2, allInt, err := numericArgs("*", v1, v2)
+	if err != nil {
+		return nil, err
+	}
+	if allInt {
+		return n1.(int) * n2.(int), nil
+	}
+	return toFloat(n1) * toFloat(n2), nil
+}
+
+func div(v1, v2 interface{}) (interface{}, error) {
+	n1, n2, _, err := numericArgs("/", v1, v2)
+	if err != nil {
+		return nil, err
+	}
+	if toFloat(n2) == 0 {
+		return nil, errors.New("division by zero")
+	}
+	return toFloat(n1) / toFloat(n2), nil
+}
+
+func mod(v1, v2 interface{}) (interface{}, error) {
+	n1, n2, allInt, err := numericArgs("%", v1, v2)
+	if err != nil {
+		return nil, err
+	}
+	if toFloat(n2) == 0 {
+		return nil, errors.New("division by zero")
+	}
+	if allInt {
+		return n1.(int) % n2.(int), nil
+	}
+	return math.Mod(toFloat(n1), toFloat(n2)), nil
+}
+
+func neg(v interface{}) (interface{}, error) {
+	n, ok := jsonNumber(v)
+	if !ok {
+		return nil, errors.New("operand of unary `-` is not numeric")
+	}
+	if i, ok := n.(int); ok {
+		return -i, nil
+	}
+	return -n.(float64), nil
+}
+
+func ne(v1, v2 interface{}) (bool, error) {
+	res, err := eq(v1, v2)
+	return !res, err
+}
+
+// compare returns -1, 0 or 1, only numbers and strings are comparable
+func compare(op string, v1, v2 interface{}) (int, error) {
+	n1, ok1 := jsonNumber(v1)
+	n2, ok2 := jsonNumber(v2)
+	if ok1 && ok2 {
+		return compareNumbers(n1, n2), nil
+	}
+	s1, ok1 := jsonString(v1)
+	s2, ok2 := jsonString(v2)
+	if ok1 && ok2 {
+		return strings.Compare(s1, s2), nil
+	}
+	return 0, fmt.Errorf("operands of `%s` should be both numbers or both strings", op)
+}
+
+func lt(v1, v2 interface{}) (bool, error) {
+	res, err := compare("<", v1, v2)
+	return res < 0, err
+}
+
+func le(v1, v2 interface{}) (bool, error) {
+	res, err := compare("<=", v1, v2)
+	return res <= 0, err
+}
+
+func gt(v1, v2 interface{}) (bool, error) {
+	res, err := compare(">", v1, v2)
+	return res > 0, err
+}
+
+func ge(v1, v2 interface{}) (bool, error) {
+	res, err := compare(">=", v1, v2)
+	return res >= 0, err
+}
+
+// in checks: item is element of array, key of object or substring of string
+func in(item, container interface{}) (bool, error) {
+	if om, ok := container.(*OrderedMap); ok {
+		key, err := jsonStringKey(item)
+		if err != nil {
+			return false, err
+		}
+		_, found := om.Get(key)
+		return found, nil
+	}
+	container, err := jsonValue(container)
+	if err != nil {
+		return false, err
+	}
+	switch tv := container.(type) {
+	case nil:
+		return false, nil
+	case string:
+		str, ok := jsonString(item)
+		if !ok {
+			return false, errors.New("left operand of `in` should be string")
+		}
+		return strings.Contains(tv, str), nil
+	case map[string]interface{}:
+		key, err := jsonStringKey(item)
+		if err != nil {
+			return false, err
+		}
+		_, ok := tv[key]
+		return ok, nil
+	case []interface{}:
+		item, err := jsonValue(item)
+		if err != nil {
+			return false, err
+		}
+		for _, val := range tv {
+			if jsonEqual(item, val) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, errors.New("right operand of `in` should be array, object or string")
+}
@@ -24,6 +24,26 @@ func (o opCode) String() string {
 
 type opCodeBuilder struct {
 	lastId int
+	loops  []opCodeLoop
+	defs   []opCodeDef
+	tries  int  //number of `try` blocks around current position
+	inDef  bool //current code is body of template-defined function
+}
+
+// opCodeDef is code of template-defined function
+type opCodeDef struct {
+	name   string
+	params []string
+	code   []opCode
+	pos    Position
+}
+
+// opCodeLoop contains labels for `break` and `continue` in loop
+type opCodeLoop struct {
+	name        string
+	lblContinue string
+	lblBreak    string
+	tries       int //number of `try` blocks around loop
 }
 
 func (b *opCodeBuilder) newId() string {
@@ -39,7 +59,12 @@ func (b *opCodeBuilder) build(node *astNode) []opCode {
 	case astCmdCodeBlock:
 		return b.buildCodeBlock(node)
 	case astCmdIf:
+		if len(node.child) > 3 {
+			return b.buildIfChain(node)
+		}
 		return b.buildIf(node)
+	case astCmdSwitch:
+		return b.buildSwitch(node)
 	case astCmdFor:
 		return b.buildFor(node)
 	case astCmdForeach:
@@ -50,6 +75,23 @@ func (b *opCodeBuilder) build(node *astNode) []opCode {
 		return b.buildJsonSet(node)
 	case astCmdAppend:
 		return b.buildAppend(node)
+	case astCmdDelete:
+		return b.buildDelete(node)
+	case astCmdUpdate:
+		return b.buildUpdate(node)
+	case astCmdTry:
+		return b.buildTry(node)
+	case astCmdAssert:
+		return b.buildAssert(node)
+	case astCmdFail:
+		return b.buildFail(node)
+	case astCmdBreak, astCmdContinue:
+		return b.buildLoopControl(node)
+	case astCmdDef:
+		b.buildDef(node)
+		return nil
+	case astCmdReturn:
+		return b.buildReturn(node)
 	}
 
 	//should be unreachable
@@ -177,6 +219,134 @@ func (b *opCodeBuilder) makeIfE(varName string, elseCode []opCode, pos Position)
 	return code
 }
 
+func (b *opCodeBuilder) buildIfChain(node *astNode) []opCode {
+	/*
+		build code for construction: if var1 {%code1%} else if var2 {%code2%} ... else {%code%}
+		commands:
+		%init condition var1%
+		jmpIf var1 Empty to @next1
+		%code1%
+		jmp @end
+		@next1
+		%init condition var2%
+		jmpIf var2 Empty to @next2
+		%code2%
+		jmp @end
+		@next2
+		...
+		%else code%
+		@end
+	*/
+	var code []opCode
+	lblEnd := b.newId()
+	last := len(node.child) - 1
+	for i := 0; i < last; i += 2 {
+		lblNext := b.newId()
+		condVar, condCode := b.buildDataPrimitive(node.child[i])
+		code = append(code, condCode...)
+		code = append(code, b.freeTmpVars(condVar)...)
+		code = append(code, opCode{
+			cmd:    vmCmdJmpIfEmpty,
+			target: lblNext,
+			fnArgs: []string{condVar},
+			pos:    node.child[i].start,
+		})
+		code = append(code, b.build(node.child[i+1])...)
+		code = append(code, opCode{
+			cmd:    vmCmdJmp,
+			target: lblEnd,
+			pos:    node.child[i].start,
+		})
+		code = append(code, opCode{
+			cmd:    opCmdLabel,
+			target: lblNext,
+		})
+	}
+	code = append(code, b.build(node.child[last])...)
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblEnd,
+	})
+	return code
+}
+
+func (b *opCodeBuilder) buildSwitch(node *astNode) []opCode {
+	/*
+		build code for construction: switch var case val1 {%code1%} ... default {%code%}
+		commands:
+		%init var%
+		%init val1%
+		call target=%tmpCond% fn="eq" args=[var, val1]
+		jmpIf %tmpCond% NotEmpty to @case1
+		...
+		jmp @default     # or @end if there is no default
+		@case1
+		%code1%
+		jmp @end
+		...
+		@default
+		%code%
+		@end
+	*/
+	valueVar, code := b.buildDataPrimitive(node.child[0])
+	lblEnd := b.newId()
+	lblDefault := lblEnd
+
+	caseNodes := node.child[1:]
+	caseLabels := make([]string, len(caseNodes))
+	for i, caseNode := range caseNodes {
+		caseLabels[i] = b.newId()
+		if caseNode.data == "default" {
+			lblDefault = caseLabels[i]
+			continue
+		}
+		for _, caseValue := range caseNode.child[:len(caseNode.child)-1] {
+			caseVar, caseCode := b.buildDataPrimitive(caseValue)
+			code = append(code, caseCode...)
+			code = append(code, b.freeTmpVars(caseVar)...)
+			condVar := b.newId()
+			code = append(code, opCode{
+				cmd:    vmCmdCall,
+				target: condVar,
+				fn:     "eq",
+				fnArgs: []string{valueVar, caseVar},
+				pos:    caseValue.start,
+			})
+			code = append(code, b.freeTmpVars(condVar)...)
+			code = append(code, opCode{
+				cmd:    vmCmdJmpIfNotEmpty,
+				target: caseLabels[i],
+				fnArgs: []string{condVar},
+				pos:    caseValue.start,
+			})
+		}
+	}
+	code = append(code, b.freeTmpVars(valueVar)...)
+	code = append(code, opCode{
+		cmd:    vmCmdJmp,
+		target: lblDefault,
+		pos:    node.start,
+	})
+
+	for i, caseNode := range caseNodes {
+		code = append(code, opCode{
+			cmd:    opCmdLabel,
+			target: caseLabels[i],
+		})
+		code = append(code, b.build(caseNode.child[len(caseNode.child)-1])...)
+		code = append(code, opCode{
+			cmd:    vmCmdJmp,
+			target: lblEnd,
+			pos:    caseNode.start,
+		})
+	}
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblEnd,
+	})
+	return code
+}
+
 func (b *opCodeBuilder) buildFor(node *astNode) []opCode {
 	/*
 		@head
@@ -189,11 +359,11 @@ func (b *opCodeBuilder) buildFor(node *astNode) []opCode {
 
 	condVar, condCode := b.buildDataPrimitive(node.child[0])
 
-	actCode := b.build(node.child[1])
-
-	clearTmp := b.freeTmpVars(condVar)
 	lblHead := b.newId()
 	lblEnd := b.newId()
+	actCode := b.buildLoopBody(node, lblHead, lblEnd, node.child[1])
+
+	clearTmp := b.freeTmpVars(condVar)
 
 	code := make([]opCode, 0, len(condCode)+len(clearTmp)+len(actCode)+4)
 	code = append(code, opCode{
@@ -309,7 +479,7 @@ func (b *opCodeBuilder) buildForeach(node *astNode) []opCode {
 	}
 
 	//foreach action code
-	actCode := b.build(node.child[3])
+	actCode := b.buildLoopBody(node, lblHead, lblEnd, node.child[3])
 	code = append(code, actCode...)
 
 	//end
@@ -327,15 +497,228 @@ func (b *opCodeBuilder) buildForeach(node *astNode) []opCode {
 	return code
 }
 
+func (b *opCodeBuilder) buildLoopBody(loop *astNode, lblContinue, lblBreak string, body *astNode) []opCode {
+	b.loops = append(b.loops, opCodeLoop{
+		name:        loop.data,
+		lblContinue: lblContinue,
+		lblBreak:    lblBreak,
+		tries:       b.tries,
+	})
+	code := b.build(body)
+	b.loops = b.loops[:len(b.loops)-1]
+	return code
+}
+
+func (b *opCodeBuilder) buildLoopControl(node *astNode) []opCode {
+	loop := b.loops[len(b.loops)-1]
+	if node.data != "" {
+		for i := len(b.loops) - 1; i >= 0; i-- {
+			if b.loops[i].name == node.data {
+				loop = b.loops[i]
+				break
+			}
+		}
+	}
+	target := loop.lblBreak
+	if node.cmd == astCmdContinue {
+		target = loop.lblContinue
+	}
+	//leave `try` blocks inside the loop
+	var code []opCode
+	for i := loop.tries; i < b.tries; i++ {
+		code = append(code, opCode{
+			cmd: vmCmdTryEnd,
+			pos: node.start,
+		})
+	}
+	return append(code, opCode{
+		cmd:    vmCmdJmp,
+		target: target,
+		pos:    node.start,
+	})
+}
+
+func (b *opCodeBuilder) buildAssert(node *astNode) []opCode {
+	/*
+		code:
+		%condition code%
+		jmpIf %condition% NotEmpty to @end
+		const %code% "assert"
+		%message code%
+		call target=%tmp% fn="@fail" args=[%code%, %message%]
+		@end
+	*/
+	lblEnd := b.newId()
+	condVar, code := b.buildDataPrimitive(node.child[0])
+	code = append(code, b.freeTmpVars(condVar)...)
+	code = append(code, opCode{
+		cmd:    vmCmdJmpIfNotEmpty,
+		target: lblEnd,
+		fnArgs: []string{condVar},
+		pos:    node.start,
+	})
+	msgNode := &astNode{
+		cmd:  astCmdConst,
+		data: `"assertion failed"`,
+	}
+	if len(node.child) > 1 {
+		msgNode = node.child[1]
+	}
+	code = append(code, b.buildFail(&astNode{
+		cmd:   astCmdFail,
+		start: node.start,
+		child: []*astNode{{cmd: astCmdConst, data: `"assert"`}, msgNode},
+	})...)
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblEnd,
+	})
+	return code
+}
+
+func (b *opCodeBuilder) buildFail(node *astNode) []opCode {
+	var args []string
+	var code []opCode
+	for _, dataNode := range node.child {
+		argName, argCode := b.buildDataPrimitive(dataNode)
+		code = append(code, argCode...)
+		args = append(args, argName)
+	}
+	code = append(code, b.freeTmpVars(args...)...)
+	target := b.newId()
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@fail",
+		fnArgs: args,
+		pos:    node.start,
+	})
+	return append(code, b.freeTmpVars(target)...)
+}
+
+func (b *opCodeBuilder) buildTry(node *astNode) []opCode {
+	/*
+		code:
+		try @catch [errVar]
+		%try code%
+		tryEnd
+		jmp @end
+		@catch
+		%catch code%
+		@end
+	*/
+	lblCatch := b.newId()
+	lblEnd := b.newId()
+	try := opCode{
+		cmd:    vmCmdTry,
+		target: lblCatch,
+		pos:    node.start,
+	}
+	if node.child[1] != nil {
+		try.fnArgs = []string{node.child[1].data}
+	}
+	code := []opCode{try}
+
+	b.tries++
+	code = append(code, b.build(node.child[0])...)
+	b.tries--
+	code = append(code, opCode{
+		cmd: vmCmdTryEnd,
+		pos: node.end,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdJmp,
+		target: lblEnd,
+		pos:    node.end,
+	})
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblCatch,
+	})
+	code = append(code, b.build(node.child[2])...)
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblEnd,
+	})
+	return code
+}
+
+func (b *opCodeBuilder) buildDef(node *astNode) {
+	/*
+		code:
+		%body%
+		const %tmpNull% null
+		ret %tmpNull%
+	*/
+	last := len(node.child) - 1
+	def := opCodeDef{
+		name: node.data,
+		pos:  node.start,
+	}
+	for _, param := range node.child[:last] {
+		def.params = append(def.params, param.data)
+	}
+	b.inDef = true
+	def.code = b.build(node.child[last])
+	b.inDef = false
+
+	null := b.newId()
+	def.code = append(def.code, opCode{
+		cmd:    opCmdConst,
+		target: null,
+		fnArgs: []string{"null"},
+	})
+	def.code = append(def.code, opCode{
+		cmd:    vmCmdRet,
+		fnArgs: []string{null},
+		pos:    node.end,
+	})
+	b.defs = append(b.defs, def)
+}
+
+func (b *opCodeBuilder) buildReturn(node *astNode) []opCode {
+	dataVar, code := b.buildDataPrimitive(node.child[0])
+	code = append(code, b.freeTmpVars(dataVar)...)
+	if !b.inDef {
+		/*
+			main code:
+			call result @result %value%
+			ret
+		*/
+		code = append(code, opCode{
+			cmd:    vmCmdCall,
+			target: "result",
+			fn:     "@result",
+			fnArgs: []string{dataVar},
+			pos:    node.start,
+		}, opCode{
+			cmd: vmCmdRet,
+			pos: node.start,
+		})
+		return code
+	}
+	code = append(code, opCode{
+		cmd:    vmCmdRet,
+		fnArgs: []string{dataVar},
+		pos:    node.start,
+	})
+	return code
+}
+
 func (b *opCodeBuilder) buildSetVar(node *astNode) []opCode {
 	dataVar, code := b.buildDataPrimitive(node.child[1])
 	code = append(code, b.freeTmpVars(dataVar)...)
 
 	varName := node.child[0].data
+	fn := "@share"
+	if varName == "result" {
+		//result is output, value is checked by limits
+		fn = "@result"
+	}
 	code = append(code, opCode{
 		cmd:    vmCmdCall,
 		target: varName,
-		fn:     "@clone",
+		fn:     fn,
 		fnArgs: []string{dataVar},
 		pos:    node.start,
 	})
@@ -354,6 +737,14 @@ func (b *opCodeBuilder) buildDataPrimitive(node *astNode) (string, []opCode) {
 		return b.dataVarPath(node)
 	case astCmdVarName:
 		return node.data, nil
+	case astCmdOperator:
+		return b.dataOperator(node)
+	case astCmdArray:
+		return b.dataLiteral("@array", node)
+	case astCmdObject:
+		return b.dataLiteral("@object", node)
+	case astCmdComprehension:
+		return b.dataComprehension(node)
 	}
 
 	//should be unreachable
@@ -370,26 +761,17 @@ func (b *opCodeBuilder) dataConst(node *astNode) (string, []opCode) {
 	return name, []opCode{cmd}
 }
 
-func (b *opCodeBuilder) dataStrTemplate(node *astNode) (string, []opCode) {
-	templateName := "%" + node.child[0].data
-	argName, code := b.buildDataPrimitive(node.child[1])
-	code = append(code, b.freeTmpVars(argName)...)
-	target := b.newId()
-	code = append(code, opCode{
-		cmd:    vmCmdCall,
-		target: target,
-		fn:     "@strTemplate",
-		fnArgs: []string{templateName, argName},
-		pos:    node.start,
-	})
-	return target, code
-}
+func (b *opCodeBuilder) dataLiteral(fnName string, node *astNode) (string, []opCode) {
+	if data, ok := constJson(node); ok {
+		return b.dataConst(&astNode{
+			cmd:  astCmdConst,
+			data: data,
+		})
+	}
 
-func (b *opCodeBuilder) dataFunction(node *astNode) (string, []opCode) {
-	fnName := node.child[0].data
 	var args []string
 	var code []opCode
-	for _, dataNode := range node.child[1:] {
+	for _, dataNode := range node.child {
 		argName, argCode := b.buildDataPrimitive(dataNode)
 		code = append(code, argCode...)
 		args = append(args, argName)
@@ -404,62 +786,595 @@ func (b *opCodeBuilder) dataFunction(node *astNode) (string, []opCode) {
 		pos:    node.start,
 	})
 	return target, code
-
 }
 
-func (b *opCodeBuilder) dataVarPath(node *astNode) (string, []opCode) {
-	varName := node.child[0].data
-	path := []string{varName}
-	var code []opCode
-	for _, dataNode := range node.child[1:] {
-		argName, argCode := b.buildDataPrimitive(dataNode)
-		code = append(code, argCode...)
-		path = append(path, argName)
-	}
-	code = append(code, b.freeTmpVars(path...)...)
+func (b *opCodeBuilder) dataComprehension(node *astNode) (string, []opCode) {
+	/*
+		code:
+		call target=%res% fn="@array|@object" args=[]
+		%dataCode%
+		call target=%tmpIterator% fn="@initIterator[k|v|kv]" args=[%dataVar%]
+		@head
+		call target=%tmpCond% fn="@iteratorStep" args[%tmpIterator%]
+		jmpIf %tmpCond% Empty to @end
+		call target=key fn="@iteratorKey" args[%tmpIterator%]  # if use key
+		call target=val fn="@iteratorVal" args[%tmpIterator%]  # if use val
+		%condition code%
+		jmpIf %condition% Empty to @head
+		%item code%
+		call target=%res% fn="@push|@put" args=[%res%, %item%...]
+		jmp @head
+		@end
+		TmpVarFree %tmpIterator%
+	*/
 	target := b.newId()
-	code = append(code, opCode{
+	lblHead := b.newId()
+	lblEnd := b.newId()
+	varIterator := b.newId()
+	varCondition := b.newId()
+
+	initFn, addFn := "@array", "@push"
+	if node.data == "object" {
+		initFn, addFn = "@object", "@put"
+	}
+	code := []opCode{{
 		cmd:    vmCmdCall,
 		target: target,
-		fn:     "@get",
-		fnArgs: path,
+		fn:     initFn,
 		pos:    node.start,
-	})
-	return target, code
-}
+	}}
 
-func (b *opCodeBuilder) freeTmpVars(names ...string) []opCode {
-	var code []opCode
-	for _, name := range names {
-		if name[0] == '@' {
-			code = append(code, opCode{
-				cmd:    opCmdTmpVarFree,
-				target: name,
-			})
-		}
+	var keyName, valName string
+	if node.child[0] != nil {
+		keyName = node.child[0].data
 	}
-	return code
-}
-
-func (b *opCodeBuilder) buildJsonSet(node *astNode) []opCode {
-	return b.buildJsonOperation("@jsonSet", node)
-}
-
-func (b *opCodeBuilder) buildAppend(node *astNode) []opCode {
-	return b.buildJsonOperation("@append", node)
-}
-
-func (b *opCodeBuilder) buildJsonOperation(fn string, node *astNode) []opCode {
-	varData, code := b.buildDataPrimitive(node.child[1])
-	pathNode := node.child[0]
-	varName := pathNode.child[0].data
-	var pathVars []string
-	for _, keyNode := range pathNode.child[1:] {
-		keyName, keyCode := b.buildDataPrimitive(keyNode)
-		code = append(code, keyCode...)
-		pathVars = append(pathVars, keyName)
+	if node.child[1] != nil {
+		valName = node.child[1].data
 	}
-	code = append(code, opCode{
+	dataVar, dataCode := b.buildDataPrimitive(node.child[2])
+	code = append(code, dataCode...)
+	code = append(code, b.freeTmpVars(dataVar)...)
+	fnName := "@initIterator"
+	if keyName != "" {
+		fnName += "K"
+	}
+	if valName != "" {
+		fnName += "V"
+	}
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: varIterator,
+		fn:     fnName,
+		fnArgs: []string{dataVar},
+		pos:    node.start,
+	})
+
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblHead,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: varCondition,
+		fn:     "@iteratorStep",
+		fnArgs: []string{varIterator},
+		pos:    node.start,
+	})
+	code = append(code, b.freeTmpVars(varCondition)...)
+	code = append(code, opCode{
+		cmd:    vmCmdJmpIfEmpty,
+		target: lblEnd,
+		fnArgs: []string{varCondition},
+		pos:    node.start,
+	})
+	if keyName != "" {
+		code = append(code, opCode{
+			cmd:    vmCmdCall,
+			target: keyName,
+			fn:     "@iteratorKey",
+			fnArgs: []string{varIterator},
+			pos:    node.start,
+		})
+	}
+	if valName != "" {
+		code = append(code, opCode{
+			cmd:    vmCmdCall,
+			target: valName,
+			fn:     "@iteratorVal",
+			fnArgs: []string{varIterator},
+			pos:    node.start,
+		})
+	}
+
+	if node.child[3] != nil {
+		condVar, condCode := b.buildDataPrimitive(node.child[3])
+		code = append(code, condCode...)
+		code = append(code, b.freeTmpVars(condVar)...)
+		code = append(code, opCode{
+			cmd:    vmCmdJmpIfEmpty,
+			target: lblHead,
+			fnArgs: []string{condVar},
+			pos:    node.child[3].start,
+		})
+	}
+
+	args := []string{target}
+	for _, item := range node.child[4:] {
+		argName, argCode := b.buildDataPrimitive(item)
+		code = append(code, argCode...)
+		args = append(args, argName)
+	}
+	code = append(code, b.freeTmpVars(args[1:]...)...)
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     addFn,
+		fnArgs: args,
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdJmp,
+		target: lblHead,
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblEnd,
+	})
+	code = append(code, b.freeTmpVars(varIterator)...)
+	return target, code
+}
+
+// constJson returns json of array or object literal if all its items are constants
+func constJson(node *astNode) (string, bool) {
+	switch node.cmd {
+	case astCmdConst:
+		return node.data, true
+	case astCmdArray, astCmdObject:
+	default:
+		return "", false
+	}
+
+	items := make([]string, len(node.child))
+	for i, child := range node.child {
+		data, ok := constJson(child)
+		if !ok {
+			return "", false
+		}
+		items[i] = data
+	}
+	if node.cmd == astCmdArray {
+		return "[" + strings.Join(items, ",") + "]", true
+	}
+
+	var res strings.Builder
+	res.WriteString("{")
+	for i := 0; i < len(items); i += 2 {
+		//only string keys can be used in json
+		if items[i][0] != '"' {
+			return "", false
+		}
+		if i > 0 {
+			res.WriteString(",")
+		}
+		res.WriteString(items[i] + ":" + items[i+1])
+	}
+	res.WriteString("}")
+	return res.String(), true
+}
+
+func (b *opCodeBuilder) dataStrTemplate(node *astNode) (string, []opCode) {
+	templateName := "%" + node.child[0].data
+	argName, code := b.buildDataPrimitive(node.child[1])
+	code = append(code, b.freeTmpVars(argName)...)
+	target := b.newId()
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@strTemplate",
+		fnArgs: []string{templateName, argName},
+		pos:    node.start,
+	})
+	return target, code
+}
+
+func (b *opCodeBuilder) dataFunction(node *astNode) (string, []opCode) {
+	fnName := node.child[0].data
+	var args []string
+	var code []opCode
+	for _, dataNode := range node.child[1:] {
+		argName, argCode := b.buildDataPrimitive(dataNode)
+		code = append(code, argCode...)
+		args = append(args, argName)
+	}
+	code = append(code, b.freeTmpVars(args...)...)
+	target := b.newId()
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     fnName,
+		fnArgs: args,
+		pos:    node.start,
+	})
+	return target, code
+
+}
+
+func (b *opCodeBuilder) dataVarPath(node *astNode) (string, []opCode) {
+	/*
+		path is split by filters:
+		call target=%list% fn="@get" args=[%var%, %key1%..., %any%]
+		%filter code%  # filtered list
+		call target=%res% fn="@get" args=[%filtered%, %any%, %key2%...]
+	*/
+	varName := node.child[0].data
+	path := []string{varName}
+	var code []opCode
+	for _, dataNode := range node.child[1:] {
+		switch dataNode.cmd {
+		case astCmdPathAny, astCmdPathDeep:
+			argName, argCode := b.dataPathMarker(dataNode)
+			code = append(code, argCode...)
+			path = append(path, argName)
+		case astCmdPathSlice:
+			argName, argCode := b.dataPathSlice(dataNode)
+			code = append(code, argCode...)
+			path = append(path, argName)
+		case astCmdPathFilter:
+			argName, argCode := b.dataPathMarker(dataNode)
+			code = append(code, argCode...)
+			path = append(path, argName)
+			code = append(code, b.freeTmpVars(path...)...)
+			list := b.newId()
+			code = append(code, opCode{
+				cmd:    vmCmdCall,
+				target: list,
+				fn:     "@get",
+				fnArgs: path,
+				pos:    node.start,
+			})
+			filtered, filterCode := b.dataPathFilter(list, dataNode)
+			code = append(code, filterCode...)
+			argName, argCode = b.dataPathMarker(dataNode)
+			code = append(code, argCode...)
+			path = []string{filtered, argName}
+		default:
+			argName, argCode := b.buildDataPrimitive(dataNode)
+			code = append(code, argCode...)
+			path = append(path, argName)
+		}
+	}
+	code = append(code, b.freeTmpVars(path...)...)
+	target := b.newId()
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@get",
+		fnArgs: path,
+		pos:    node.start,
+	})
+	return target, code
+}
+
+// dataPathMarker builds path item which matches all children (or all descendants for astCmdPathDeep)
+func (b *opCodeBuilder) dataPathMarker(node *astNode) (string, []opCode) {
+	fn := "@pathAny"
+	if node.cmd == astCmdPathDeep {
+		fn = "@pathDeep"
+	}
+	target := b.newId()
+	return target, []opCode{{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     fn,
+		pos:    node.start,
+	}}
+}
+
+func (b *opCodeBuilder) dataPathSlice(node *astNode) (string, []opCode) {
+	var code []opCode
+	var args []string
+	for _, item := range node.child {
+		if item == nil {
+			argName := b.newId()
+			code = append(code, opCode{
+				cmd:    opCmdConst,
+				target: argName,
+				fnArgs: []string{"null"},
+			})
+			args = append(args, argName)
+			continue
+		}
+		argName, argCode := b.buildDataPrimitive(item)
+		code = append(code, argCode...)
+		args = append(args, argName)
+	}
+	code = append(code, b.freeTmpVars(args...)...)
+	target := b.newId()
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@pathSlice",
+		fnArgs: args,
+		pos:    node.start,
+	})
+	return target, code
+}
+
+func (b *opCodeBuilder) dataPathFilter(list string, node *astNode) (string, []opCode) {
+	/*
+		code:
+		call target=%res% fn="@array" args=[]
+		call target=%tmpIterator% fn="@initIteratorV" args=[%list%]
+		@head
+		call target=%tmpCond% fn="@iteratorStep" args[%tmpIterator%]
+		jmpIf %tmpCond% Empty to @end
+		call target=%item% fn="@iteratorVal" args[%tmpIterator%]
+		%condition code%
+		jmpIf %condition% Empty to @head
+		call target=%res% fn="@append" args=[%res%, %item%]
+		jmp @head
+		@end
+		TmpVarFree %tmpIterator%
+	*/
+	itemName := node.data
+	target := b.newId()
+	lblHead := b.newId()
+	lblEnd := b.newId()
+	varIterator := b.newId()
+	varCondition := b.newId()
+
+	code := []opCode{{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@array",
+		pos:    node.start,
+	}, {
+		cmd:    vmCmdCall,
+		target: varIterator,
+		fn:     "@initIteratorV",
+		fnArgs: []string{list},
+		pos:    node.start,
+	}}
+	code = append(code, b.freeTmpVars(list)...)
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblHead,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: varCondition,
+		fn:     "@iteratorStep",
+		fnArgs: []string{varIterator},
+		pos:    node.start,
+	})
+	code = append(code, b.freeTmpVars(varCondition)...)
+	code = append(code, opCode{
+		cmd:    vmCmdJmpIfEmpty,
+		target: lblEnd,
+		fnArgs: []string{varCondition},
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: itemName,
+		fn:     "@iteratorVal",
+		fnArgs: []string{varIterator},
+		pos:    node.start,
+	})
+
+	condVar, condCode := b.buildDataPrimitive(node.child[0])
+	code = append(code, condCode...)
+	code = append(code, b.freeTmpVars(condVar)...)
+	code = append(code, opCode{
+		cmd:    vmCmdJmpIfEmpty,
+		target: lblHead,
+		fnArgs: []string{condVar},
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@append",
+		fnArgs: []string{target, itemName},
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdJmp,
+		target: lblHead,
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblEnd,
+	})
+	code = append(code, b.freeTmpVars(varIterator)...)
+	return target, code
+}
+
+var operatorFunctions = map[string]string{
+	"+":  "@add",
+	"-":  "@sub",
+	"*":  "@mul",
+	"/":  "@div",
+	"%":  "@mod",
+	"==": "eq",
+	"!=": "@ne",
+	"<":  "@lt",
+	"<=": "@le",
+	">":  "@gt",
+	">=": "@ge",
+	"in": "@in",
+}
+
+var unaryOperatorFunctions = map[string]string{
+	"!": "not",
+	"-": "@neg",
+}
+
+func (b *opCodeBuilder) dataOperator(node *astNode) (string, []opCode) {
+	switch node.data {
+	case "&&":
+		return b.dataLogical(vmCmdJmpIfEmpty, node)
+	case "||":
+		return b.dataLogical(vmCmdJmpIfNotEmpty, node)
+	case "??":
+		return b.dataCoalesce(node)
+	}
+
+	fnName := operatorFunctions[node.data]
+	if len(node.child) == 1 {
+		fnName = unaryOperatorFunctions[node.data]
+	}
+	var args []string
+	var code []opCode
+	for _, dataNode := range node.child {
+		argName, argCode := b.buildDataPrimitive(dataNode)
+		code = append(code, argCode...)
+		args = append(args, argName)
+	}
+	code = append(code, b.freeTmpVars(args...)...)
+	target := b.newId()
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     fnName,
+		fnArgs: args,
+		pos:    node.start,
+	})
+	return target, code
+}
+
+func (b *opCodeBuilder) dataLogical(jmp vmCmdType, node *astNode) (string, []opCode) {
+	/*
+		build code for short-circuit `&&` and `||`
+		commands:
+		%left code%
+		call target=%res% fn="@bool" args=[%left%]
+		jmpIf %res% Empty to @end  # NotEmpty for `||`
+		%right code%
+		call target=%res% fn="@bool" args=[%right%]
+		@end
+	*/
+	target := b.newId()
+	lblEnd := b.newId()
+
+	leftVar, code := b.buildDataPrimitive(node.child[0])
+	code = append(code, b.freeTmpVars(leftVar)...)
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@bool",
+		fnArgs: []string{leftVar},
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    jmp,
+		target: lblEnd,
+		fnArgs: []string{target},
+		pos:    node.start,
+	})
+
+	rightVar, rightCode := b.buildDataPrimitive(node.child[1])
+	code = append(code, rightCode...)
+	code = append(code, b.freeTmpVars(rightVar)...)
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@bool",
+		fnArgs: []string{rightVar},
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblEnd,
+	})
+	return target, code
+}
+
+func (b *opCodeBuilder) dataCoalesce(node *astNode) (string, []opCode) {
+	/*
+		build code for short-circuit `??`
+		commands:
+		%left code%
+		call target=%res% fn="@value" args=[%left%]
+		call target=%isSet% fn="@isSet" args=[%left%]
+		jmpIfNotEmpty %isSet% to @end
+		%right code%
+		call target=%res% fn="@value" args=[%right%]
+		@end
+	*/
+	target := b.newId()
+	isSet := b.newId()
+	lblEnd := b.newId()
+
+	leftVar, code := b.buildDataPrimitive(node.child[0])
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@value",
+		fnArgs: []string{leftVar},
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: isSet,
+		fn:     "@isSet",
+		fnArgs: []string{leftVar},
+		pos:    node.start,
+	})
+	code = append(code, b.freeTmpVars(leftVar)...)
+	code = append(code, opCode{
+		cmd:    vmCmdJmpIfNotEmpty,
+		target: lblEnd,
+		fnArgs: []string{isSet},
+		pos:    node.start,
+	})
+	code = append(code, b.freeTmpVars(isSet)...)
+
+	rightVar, rightCode := b.buildDataPrimitive(node.child[1])
+	code = append(code, rightCode...)
+	code = append(code, b.freeTmpVars(rightVar)...)
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: target,
+		fn:     "@value",
+		fnArgs: []string{rightVar},
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    opCmdLabel,
+		target: lblEnd,
+	})
+	return target, code
+}
+
+func (b *opCodeBuilder) freeTmpVars(names ...string) []opCode {
+	var code []opCode
+	for _, name := range names {
+		if name[0] == '@' {
+			code = append(code, opCode{
+				cmd:    opCmdTmpVarFree,
+				target: name,
+			})
+		}
+	}
+	return code
+}
+
+func (b *opCodeBuilder) buildJsonSet(node *astNode) []opCode {
+	return b.buildJsonOperation("@jsonSet", node)
+}
+
+func (b *opCodeBuilder) buildAppend(node *astNode) []opCode {
+	return b.buildJsonOperation("@append", node)
+}
+
+func (b *opCodeBuilder) buildJsonOperation(fn string, node *astNode) []opCode {
+	varData, code := b.buildDataPrimitive(node.child[1])
+	varName, pathVars, pathCode := b.buildPathKeys(node.child[0])
+	code = append(code, pathCode...)
+	code = append(code, opCode{
 		cmd:    vmCmdCall,
 		target: varName,
 		fn:     fn,
@@ -470,3 +1385,96 @@ func (b *opCodeBuilder) buildJsonOperation(fn string, node *astNode) []opCode {
 	code = append(code, b.freeTmpVars(pathVars...)...)
 	return code
 }
+
+func (b *opCodeBuilder) buildDelete(node *astNode) []opCode {
+	varName, pathVars, code := b.buildPathKeys(node.child[0])
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: varName,
+		fn:     "@delete",
+		fnArgs: append([]string{varName}, pathVars...),
+		pos:    node.start,
+	})
+	code = append(code, b.freeTmpVars(pathVars...)...)
+	return code
+}
+
+func (b *opCodeBuilder) buildUpdate(node *astNode) []opCode {
+	fnName := operatorFunctions[node.data]
+	if node.data == "<<" {
+		fnName = "@merge"
+	}
+	varData, code := b.buildDataPrimitive(node.child[1])
+	varName, pathVars, pathCode := b.buildPathKeys(node.child[0])
+	code = append(code, pathCode...)
+	if len(pathVars) == 0 {
+		code = append(code, opCode{
+			cmd:    vmCmdCall,
+			target: varName,
+			fn:     fnName,
+			fnArgs: []string{varName, varData},
+			pos:    node.start,
+		})
+		code = append(code, b.freeTmpVars(varData)...)
+		return code
+	}
+
+	if fnName == "@merge" {
+		//merge changes value by path in place
+		code = append(code, opCode{
+			cmd:    vmCmdCall,
+			target: varName,
+			fn:     fnName,
+			fnArgs: append([]string{varName, varData}, pathVars...),
+			pos:    node.start,
+		})
+		code = append(code, b.freeTmpVars(varData)...)
+		code = append(code, b.freeTmpVars(pathVars...)...)
+		return code
+	}
+
+	cur := b.newId()
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: cur,
+		fn:     "@get",
+		fnArgs: append([]string{varName}, pathVars...),
+		pos:    node.start,
+	})
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: cur,
+		fn:     fnName,
+		fnArgs: []string{cur, varData},
+		pos:    node.start,
+	})
+	code = append(code, b.freeTmpVars(varData)...)
+	code = append(code, opCode{
+		cmd:    vmCmdCall,
+		target: varName,
+		fn:     "@jsonSet",
+		fnArgs: append([]string{varName, cur}, pathVars...),
+		pos:    node.start,
+	})
+	code = append(code, b.freeTmpVars(cur)...)
+	code = append(code, b.freeTmpVars(pathVars...)...)
+	return code
+}
+
+// buildPathKeys returns var name of path root and vars with path keys
+func (b *opCodeBuilder) buildPathKeys(pathNode *astNode) (string, []string, []opCode) {
+	var code []opCode
+	var pathVars []string
+	for _, keyNode := range pathNode.child[1:] {
+		var keyName string
+		var keyCode []opCode
+		if keyNode.cmd == astCmdPathSlice {
+			keyName, keyCode = b.dataPathSlice(keyNode)
+		} else {
+			keyName, keyCode = b.buildDataPrimitive(keyNode)
+		}
+		code = append(code, keyCode...)
+		pathVars = append(pathVars, keyName)
+	}
+	return pathNode.child[0].data, pathVars, code
+}
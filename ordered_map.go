@@ -0,0 +1,159 @@
+package json_template
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// OrderedMap is json object which keeps insertion order of keys,
+// it is used for objects when Options.OrderedObjects is enabled
+type OrderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// NewOrderedMap creates empty object
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{values: map[string]interface{}{}}
+}
+
+// Len returns number of keys
+func (m *OrderedMap) Len() int {
+	return len(m.keys)
+}
+
+// Keys returns keys in insertion order
+func (m *OrderedMap) Keys() []string {
+	return append([]string{}, m.keys...)
+}
+
+// Get returns value of key, second value is false if key is not found
+func (m *OrderedMap) Get(key string) (interface{}, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+// Set changes value of key, new key is added to the end
+func (m *OrderedMap) Set(key string, val interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = val
+}
+
+// Delete removes key
+func (m *OrderedMap) Delete(key string) {
+	if _, ok := m.values[key]; !ok {
+		return
+	}
+	delete(m.values, key)
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// copy returns shallow copy of map
+func (m *OrderedMap) copy() *OrderedMap {
+	res := &OrderedMap{
+		keys:   append(make([]string, 0, len(m.keys)), m.keys...),
+		values: make(map[string]interface{}, len(m.values)),
+	}
+	for key, val := range m.values {
+		res.values[key] = val
+	}
+	return res
+}
+
+// items returns snapshot of keys and values in insertion order
+func (m *OrderedMap) items() *orderedItems {
+	res := &orderedItems{isObject: true, keys: m.Keys(), values: make([]interface{}, len(m.keys))}
+	for i, key := range m.keys {
+		res.values[i] = m.values[key]
+	}
+	return res
+}
+
+// MarshalJSON writes keys in insertion order
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON reads object keeping order of keys, nested objects are decoded as OrderedMap too
+func (m *OrderedMap) UnmarshalJSON(data []byte) error {
+	v, err := decodeOrdered(data)
+	if err != nil {
+		return err
+	}
+	res, ok := v.(*OrderedMap)
+	if !ok {
+		return errors.New("json value is not an object")
+	}
+	*m = *res
+	return nil
+}
+
+// decodeOrdered decodes json with objects as OrderedMap
+func decodeOrdered(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	return decodeOrderedValue(dec)
+}
+
+func decodeOrderedValue(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		m := NewOrderedMap()
+		for dec.More() {
+			t, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := t.(string)
+			val, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			m.Set(key, val)
+		}
+		_, err = dec.Token()
+		return m, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			val, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+		_, err = dec.Token()
+		return arr, err
+	}
+	return t, nil
+}
@@ -1,6 +1,7 @@
 package json_template
 
 import (
+	"context"
 	"encoding/json"
 	"reflect"
 	"text/template"
@@ -12,13 +13,31 @@ type Options struct {
 	prototype interface{}
 	strTml    map[string]string
 	strFunc   template.FuncMap
+	limits    limits
+	ordered   bool
+}
+
+// limits of one template execution, 0 means no limit
+type limits struct {
+	maxInstructions   int
+	maxLoopIterations int
+	maxCallDepth      int
+	maxArrayGap       int
+	maxOutputNodes    int
+	maxOutputBytes    int
+	maxStringLength   int
+	maxDepth          int
 }
 
 type Template struct {
 	functions   []reflect.Value
+	external    []bool
+	defs        []vmDef
 	constData   []reflect.Value
 	varDataSize int
 	code        []vmCmd
+	limits      limits
+	ordered     bool
 }
 
 func ParseTemplate(deps *Options, code string) (*Template, error) {
@@ -29,25 +48,49 @@ func ParseTemplate(deps *Options, code string) (*Template, error) {
 	}
 	t := Template{
 		functions:   cmp.functions,
+		external:    cmp.external,
+		defs:        cmp.defs,
 		constData:   cmp.constData,
 		varDataSize: cmp.varDataSize,
 		code:        cmp.vmCode,
 	}
+	if deps != nil {
+		t.limits = deps.limits
+		t.ordered = deps.ordered
+	}
 	return &t, nil
 }
 
+// Execute runs template with params as `args`. Template never changes params and constants:
+// objects and arrays which are not created by current execution are copied before change,
+// so one template can be executed concurrently.
+// Execute doesn't panic: runtime faults are returned as RuntimeError with position in template code.
 func (t *Template) Execute(params interface{}) (interface{}, error) {
+	return t.ExecuteContext(context.Background(), params)
+}
+
+// ExecuteContext is Execute which stops with ctx.Err() when ctx is done
+func (t *Template) ExecuteContext(ctx context.Context, params interface{}) (interface{}, error) {
+	return t.newVm(ctx, params).run()
+}
+
+func (t *Template) newVm(ctx context.Context, params interface{}) *vm {
 	if params == nil {
 		params = json.RawMessage(`null`)
 	}
-	v := vm{}
+	v := &vm{}
 	v.data[0] = t.constData
 	v.data[1] = make([]reflect.Value, t.varDataSize)
 	v.data[1][0] = zeroPrototype
 	v.data[1][1] = reflect.ValueOf(params)
 	v.functions = t.functions
+	v.external = t.external
+	v.defs = t.defs
 	v.code = t.code
-	return v.run()
+	v.ctx = ctx
+	v.limits = t.limits
+	v.ordered = t.ordered
+	return v
 }
 
 var zeroPrototype = reflect.ValueOf(json.RawMessage(`null`))
@@ -65,14 +108,85 @@ func (o *Options) Prototype(v interface{}) *Options {
 	return o
 }
 
+// OrderedObjects enables OrderedMap for objects changed or created by template,
+// so result keeps order of keys from prototype, consts, args and template code
+func (o *Options) OrderedObjects(enable bool) *Options {
+	o.ordered = enable
+	return o
+}
+
+// MaxInstructions limits number of executed instructions
+func (o *Options) MaxInstructions(n int) *Options {
+	o.limits.maxInstructions = n
+	return o
+}
+
+// MaxLoopIterations limits total number of iterations of all loops in one execution
+func (o *Options) MaxLoopIterations(n int) *Options {
+	o.limits.maxLoopIterations = n
+	return o
+}
+
+// MaxCallDepth limits nesting of template-defined function calls
+func (o *Options) MaxCallDepth(n int) *Options {
+	o.limits.maxCallDepth = n
+	return o
+}
+
+// MaxArrayGap limits number of nulls added to array when value is set by index outside of array
+func (o *Options) MaxArrayGap(n int) *Options {
+	o.limits.maxArrayGap = n
+	return o
+}
+
+// MaxOutputNodes limits total number of json values written to objects and arrays in one execution
+func (o *Options) MaxOutputNodes(n int) *Options {
+	o.limits.maxOutputNodes = n
+	return o
+}
+
+// MaxOutputBytes limits total approximate json size of values written to objects and arrays in one execution
+func (o *Options) MaxOutputBytes(n int) *Options {
+	o.limits.maxOutputBytes = n
+	return o
+}
+
+// MaxStringLength limits length of strings created by template
+func (o *Options) MaxStringLength(n int) *Options {
+	o.limits.maxStringLength = n
+	return o
+}
+
+// MaxDepth limits nesting depth of objects and arrays created by template
+func (o *Options) MaxDepth(n int) *Options {
+	o.limits.maxDepth = n
+	return o
+}
+
 var reservedKeywords = map[string]bool{
-	"result": true,
-	"args":   true,
-	"if":     true,
-	"else":   true,
-	"end":    true,
-	"for":    true,
-	"in":     true,
+	"result":   true,
+	"args":     true,
+	"if":       true,
+	"else":     true,
+	"end":      true,
+	"for":      true,
+	"in":       true,
+	"switch":   true,
+	"case":     true,
+	"default":  true,
+	"break":    true,
+	"continue": true,
+	"def":      true,
+	"return":   true,
+	"true":     true,
+	"false":    true,
+	"null":     true,
+	"delete":   true,
+	"try":      true,
+	"catch":    true,
+	"assert":   true,
+	"fail":     true,
+	"let":      true,
 }
 
 func (o *Options) checkName(name string) error {
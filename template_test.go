@@ -1,10 +1,14 @@
 package json_template
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 const codeSample1 = `result=%%{"x":null}%% 
@@ -237,3 +241,1472 @@ func TestTemplateFuncArgType(t *testing.T) {
 	}
 	//todo: position should be [1:9] - incorrect func arg
 }
+
+func TestTemplateOperators(t *testing.T) {
+	code := `
+	result.sum = args.a + 1 < args.b
+	result.arith = (args.a + 2) * 3 - 10 / 4 % 2
+	result.neg = -args.a
+	result.str = "n" + args.a + "-" + args.name
+	result.eq = args.a == 1 && args.name != "x"
+	result.or = args.missing || args.name
+	result.in = args.name in args.list
+	result.inObj = "b" in args.obj
+	result.inStr = "ll" in "hello"
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(json.RawMessage(`{"a":1, "b":3, "name":"x", "list":["y","x"], "obj":{"b":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{"sum":true, "arith":8.5, "neg":-1, "str":"n1-x", "eq":false, "or":true, "in":true, "inObj":true, "inStr":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tml, err = ParseTemplate(nil, `result = args / 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(1)
+	if err == nil {
+		t.Fatal("expect division by zero error")
+	}
+}
+
+func TestTemplateComments(t *testing.T) {
+	code := `# build filter
+	result = %%{
+		# line comment
+		"a": "#not comment", // comment
+		/* block
+		   comment */
+		"b": "/* not comment */"
+	}%%
+	result.c = 4 / 2 // division`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{"a":"#not comment", "b":"/* not comment */", "c":2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateElseIfSwitch(t *testing.T) {
+	code := `
+	if args.n < 0
+		result.sign = "negative"
+	else if args.n == 0
+		result.sign = "zero"
+	else if args.n < 10
+		result.sign = "small"
+	else
+		result.sign = "big"
+	end
+	switch args.type
+	case "term", "match"
+		result.query = args.type
+	case "range"
+		result.query = "range"
+	default
+		result.query = "match_all"
+	end
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct{ args, expect string }{
+		{`{"n":-1, "type":"match"}`, `{"sign":"negative", "query":"match"}`},
+		{`{"n":0, "type":"range"}`, `{"sign":"zero", "query":"range"}`},
+		{`{"n":5, "type":"term"}`, `{"sign":"small", "query":"term"}`},
+		{`{"n":50}`, `{"sign":"big", "query":"match_all"}`},
+	}
+	for _, c := range cases {
+		res, err := tml.Execute(json.RawMessage(c.args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkExecuteRes(res, c.expect)
+		if err != nil {
+			t.Fatal(c.args, err)
+		}
+	}
+}
+
+func TestTemplateBreakContinue(t *testing.T) {
+	code := `
+	result = %%[]%%
+	outer: for _ row in args
+		for _ v in row
+			if v == 0
+				continue outer
+			end
+			if v < 0
+				break outer
+			end
+			if v > 100
+				continue
+			end
+			result[] = v
+		end
+	end
+	i = 0
+	for 1
+		i = i + 1
+		if i > 3
+			break
+		end
+	end
+	result[] = i
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(json.RawMessage(`[[1, 200, 2], [3, 0, 4], [5, -1, 6], [7]]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `[1, 2, 3, 5, 4]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseTemplate(nil, `if 1 break end`)
+	pErr, ok := err.(ParseError)
+	if !ok || pErr.Msg != ErrLoopControlOutsideLoop {
+		t.Fatal("expect error for break outside loop, got:", err)
+	}
+
+	_, err = ParseTemplate(nil, "outer: for i in args\n\tfor j in i\n\t\tbreak outre\n\tend\nend")
+	pErr, ok = err.(ParseError)
+	if !ok || pErr.Msg != ErrUnknownLoopLabel || pErr.Pos.Line() != 3 {
+		t.Fatal("expect unknown label error, got:", err)
+	}
+}
+
+func TestTemplateDef(t *testing.T) {
+	code := `
+	def rangeFilter(field, from, to)
+		filter = %%{"range":{}}%%
+		filter.range[field] = %%{}%%
+		if from
+			filter.range[field].gte = from
+		end
+		if to
+			filter.range[field].lt = to
+		end
+		return filter
+	end
+	def fact(n)
+		if n <= 1
+			return 1
+		end
+		return n * fact(n - 1)
+	end
+	def nothing()
+	end
+	result.price = rangeFilter("price", args.min, args.none)
+	result.date = rangeFilter("date", args.from, args.to)
+	result.fact = fact(args.n)
+	result.nothing = nothing()
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(json.RawMessage(`{"min":10, "from":"2020", "to":"2021", "n":5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"price":{"range":{"price":{"gte":10}}},
+		"date":{"range":{"date":{"gte":"2020", "lt":"2021"}}},
+		"fact":120,
+		"nothing":null
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseTemplate(nil, `def f(a) return a end result = f(1, 2)`)
+	if err == nil {
+		t.Fatal("expect wrong number of args error")
+	}
+	_, err = ParseTemplate(nil, `def f(a) result = a end`)
+	if err == nil {
+		t.Fatal("expect error for `result` inside function")
+	}
+	_, err = ParseTemplate(nil, `def sum(a) return a end`)
+	if err == nil {
+		t.Fatal("expect error for redefined function")
+	}
+
+	//function without return gives null, null constant is empty
+	tml, err = ParseTemplate(nil, `
+	def f() x = 1 end
+	result = {"f": 1, "null": 1}
+	if f() result.f = 2 end
+	if %%null%% result.null = 2 end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{"f": 1, "null": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateLiterals(t *testing.T) {
+	code := `
+	result = {"data": [], "const": {"a": [1, "2", {"b": 3}]}}
+	for key val in args
+		result.data[] = {"name": key, "value": val + 1, "tags": [key, "x"]}
+	end
+	result.data[] = []
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(map[string]int{"k": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"data": [{"name": "k", "value": 2, "tags": ["k", "x"]}, []],
+		"const": {"a": [1, "2", {"b": 3}]}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//fully constant literal is stored once in const data
+	cmp := compiler{}
+	err = cmp.compile(`x = [1, {"a": 2}] y = %%[1,{"a":2}]%% z = [1, x]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmp.constData) != 2 {
+		t.Fatalf("expect 2 consts, got %d", len(cmp.constData))
+	}
+}
+
+func TestTemplateBoolNullLiterals(t *testing.T) {
+	code := `
+	result = {"t": true, "f": false, "n": null, "list": [true, null]}
+	if args.flag == true && !false
+		result.flag = true
+	end
+	result.missing = args.none == null
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(map[string]bool{"flag": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"t": true, "f": false, "n": null, "list": [true, null],
+		"flag": true, "missing": true
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmp := compiler{}
+	err = cmp.compile(`x = true y = true z = %%true%% n = null m = null`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmp.constData) != 2 {
+		t.Fatalf("expect 2 consts, got %d", len(cmp.constData))
+	}
+
+	_, err = ParseTemplate(nil, `null = 1`)
+	if err == nil {
+		t.Fatal("expect error for null as var name")
+	}
+
+	//null is empty in conditions, the same as missing or null arg
+	tml, err = ParseTemplate(nil, `
+	result = {"if": 1, "arg": 1}
+	if null result.if = 2 end
+	if args.n result.arg = 2 end
+	result.not = !null
+	result.or = null || "x"
+	result.and = null && "x"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range []interface{}{nil, json.RawMessage(`{"n": null}`)} {
+		res, err = tml.Execute(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkExecuteRes(res, `{"if": 1, "arg": 1, "not": true, "or": true, "and": false}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTemplateDelete(t *testing.T) {
+	opt := NewOptions().Prototype(json.RawMessage(
+		`{"query": {"bool": {"filter": [], "must": []}}, "list": [1, 2, 3, 4]}`,
+	))
+	code := `
+	delete result.query.bool.filter
+	delete result.list[1]
+	delete result.list[-1]
+	delete result.missing.key
+	x = {"a": [1, {"b": 2, "c": 3}]}
+	delete x.a[1].b
+	result.x = x
+	`
+	tml, err := ParseTemplate(opt, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"query": {"bool": {"must": []}},
+		"list": [1, 3],
+		"x": {"a": [1, {"c": 3}]}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseTemplate(nil, `delete 1`)
+	if err == nil {
+		t.Fatal("expect error for delete without var")
+	}
+}
+
+func TestTemplateUpdate(t *testing.T) {
+	code := `
+	i = 1
+	i += 2
+	i *= 4
+	i -= 2
+	i %= 4
+	s = "a"
+	s += "b"
+	result = {"n": i, "s": s, "list": [5]}
+	result.list[0] /= 2
+	result.list[] = 0
+	result.list[1] += 1
+	result.query <<= {"bool": {"must": [1], "x": 1}}
+	result.query <<= {"bool": {"must": [2], "x": {"y": 2}}, "size": 10}
+	obj = {"a": {"b": 1}}
+	result.obj <<= obj
+	obj.a.b = 2
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"n": 2, "s": "ab", "list": [2.5, 1],
+		"query": {"bool": {"must": [1, 2], "x": {"y": 2}}, "size": 10},
+		"obj": {"a": {"b": 1}}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateCoalesce(t *testing.T) {
+	code := `
+	result = {
+		"size": args.size ?? 10,
+		"from": args.from ?? 10,
+		"flag": args.flag ?? true,
+		"name": args.name ?? args.alias ?? "none",
+		"sum": args.from ?? 1 + 2,
+		"def": default(args.missing, "x"),
+		"defZero": default(args.from, 5)
+	}
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(json.RawMessage(`{"from": 0, "flag": false, "size": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"size": 10, "from": 0, "flag": false, "name": "none", "sum": 0, "def": "x", "defZero": 0
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateWildcardPath(t *testing.T) {
+	code := `
+	result.ids = args.items[*].id
+	result.names = args.items.*.name
+	result.allIds = args..id
+	result.active = args.items[?(@.active)].id
+	result.big = args.items[?(@.size > 1 && "x" in @.tags[?(@ == "x")])]
+	result.empty = args.missing[*]
+	for _ id in args.items[*].id
+		result.loop[] = id
+	end
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(json.RawMessage(`{"items": [
+		{"id": 1, "name": "a", "active": true, "size": 1, "tags": ["x"]},
+		{"id": 2, "name": "b", "active": false, "size": 2, "tags": ["y", "x"]},
+		{"id": 3, "name": "c", "size": 3, "tags": []}
+	], "obj": {"sub": {"id": 4}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"ids": [1, 2, 3],
+		"names": ["a", "b", "c"],
+		"allIds": [1, 2, 3, 4],
+		"active": [1],
+		"big": [{"id": 2, "name": "b", "active": false, "size": 2, "tags": ["y", "x"]}],
+		"empty": [],
+		"loop": [1, 2, 3]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseTemplate(nil, `result.items[*].id = 1`)
+	pErr, ok := err.(ParseError)
+	if !ok || pErr.Msg != ErrWildcardAssign {
+		t.Fatal("expect wildcard assign error, got:", err)
+	}
+}
+
+func TestTemplateSlice(t *testing.T) {
+	code := `
+	a = args.list
+	result = {
+		"last": a[-1],
+		"outside": a[-10],
+		"mid": a[1:3],
+		"head": a[:-1],
+		"even": a[::2],
+		"rev": a[::-1],
+		"tail": a[-2:],
+		"clamp": a[-100:100],
+		"empty": a[3:1],
+		"first": a[1:][0]
+	}
+	b = [1, 2, 3, 4, 5]
+	b[1:3] = ["x"]
+	result.set = b
+	c = [1, 2, 3]
+	c[:0] = [0]
+	c[10:] = [4]
+	delete c[1:-1]
+	result.set2 = c
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(json.RawMessage(`{"list": [0, 1, 2, 3, 4]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"last": 4,
+		"outside": null,
+		"mid": [1, 2],
+		"head": [0, 1, 2, 3],
+		"even": [0, 2, 4],
+		"rev": [4, 3, 2, 1, 0],
+		"tail": [3, 4],
+		"clamp": [0, 1, 2, 3, 4],
+		"empty": [],
+		"first": 1,
+		"set": [1, "x", 4, 5],
+		"set2": [0, 4]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseTemplate(nil, `result[1:2].x = 1`)
+	pErr, ok := err.(ParseError)
+	if !ok || pErr.Msg != ErrSliceAssign {
+		t.Fatal("expect slice assign error, got:", err)
+	}
+}
+
+func TestTemplateRange(t *testing.T) {
+	code := `
+	for i in range(3)
+		result.a[] = i
+	end
+	for i in range(10, 0, -3)
+		result.b[] = i
+	end
+	for _ v in range(0, 1, 0.25)
+		result.c[] = v
+	end
+	for i in range(args.from, args.to)
+		result.buckets[] = {"from": i * 10, "to": (i + 1) * 10}
+	end
+	result.d = range(2)
+	for i in range(1000000000)
+		if i == 2
+			break
+		end
+	end
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(map[string]int{"from": 1, "to": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"a": [0, 1, 2],
+		"b": [10, 7, 4, 1],
+		"c": [0, 0.25, 0.5, 0.75],
+		"buckets": [{"from": 10, "to": 20}, {"from": 20, "to": 30}],
+		"d": [0, 1]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tml, err = ParseTemplate(nil, `for i in range(0, 1, 0) end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if err == nil {
+		t.Fatal("expect error for zero step")
+	}
+}
+
+func TestTemplateComprehension(t *testing.T) {
+	code := `
+	result = {
+		"ids": [item.id for _ item in args.items if item.active],
+		"double": [i * 2 for i in range(3)],
+		"byId": {"id" + item.id: item.name for _ item in args.items},
+		"flags": {k: v for k v in args.flags if v},
+		"nested": [[x for x in range(i)] for i in range(3)],
+		"empty": [x for x in args.missing]
+	}
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(json.RawMessage(`{
+		"items": [{"id": 1, "name": "a", "active": true}, {"id": 2, "name": "b"}],
+		"flags": {"x": true, "y": false, "z": 1}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"ids": [1],
+		"double": [0, 2, 4],
+		"byId": {"id1": "a", "id2": "b"},
+		"flags": {"x": true, "z": 1},
+		"nested": [[], [0], [0, 1]],
+		"empty": []
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseTemplate(nil, `x = [i for i in args, 1]`)
+	if err == nil {
+		t.Fatal("expect error for comprehension with items")
+	}
+}
+
+func TestTemplateTryCatch(t *testing.T) {
+	opt := NewOptions()
+	err := opt.Func("check", func(v int) (int, error) {
+		if v < 0 {
+			return 0, fmt.Errorf("negative value %d", v)
+		}
+		return v, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := `
+	def safeCheck(v)
+		try
+			return check(v)
+		catch
+			return -1
+		end
+	end
+	def badCheck(v)
+		return check(v)
+	end
+	result = {"list": []}
+	try
+		result.list["x"] = 1
+	catch err
+		result.err = err
+	end
+	try
+		result.a = check(1)
+		result.b = badCheck(-1)
+		result.c = 1
+	catch e
+		result.message = e.message
+	end
+	for i in range(5)
+		try
+			if i == 2
+				continue
+			end
+			if i == 3
+				break
+			end
+			result.loop[] = check(i)
+		catch
+		end
+	end
+	result.safe = [safeCheck(1), safeCheck(-1)]
+	try
+		try
+			x = check(-5)
+		catch
+			result.inner = true
+			x = check(-6)
+		end
+	catch e
+		result.outer = e.message
+	end
+	`
+	tml, err := ParseTemplate(opt, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"list": [],
+		"err": {"message": "can`+"`"+`t use `+"`"+`x`+"`"+` as array index", "line": 14, "column": 2},
+		"a": 1,
+		"message": "negative value -1",
+		"loop": [0, 1],
+		"safe": [1, -1],
+		"inner": true,
+		"outer": "negative value -6"
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//error after try block is not caught
+	tml, err = ParseTemplate(opt, `try x = 1 catch end x = check(-1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if _, ok := err.(RuntimeError); !ok {
+		t.Fatalf("expect RuntimeError, got %v", err)
+	}
+}
+
+func TestTemplateAssertFail(t *testing.T) {
+	code := `
+	assert args.size > 0, "size should be positive"
+	assert args.from >= 0
+	if args.size > 100
+		fail("size_limit", "size is too big", {"max": 100, "size": args.size})
+	end
+	try
+		fail("inner", "caught")
+	catch err
+		result.caught = err
+	end
+	result.ok = true
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tml.Execute(map[string]int{"size": 10, "from": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"caught": {"code": "inner", "message": "caught", "data": null, "line": 8, "column": 2},
+		"ok": true
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tml.Execute(map[string]int{"size": 0})
+	var tErr TemplateError
+	if !errors.As(err, &tErr) {
+		t.Fatalf("expect TemplateError, got %v", err)
+	}
+	if tErr.Code != "assert" || tErr.Message != "size should be positive" || tErr.Pos.Line() != 2 {
+		t.Fatal("incorrect error:", tErr)
+	}
+
+	_, err = tml.Execute(map[string]int{"size": 1, "from": -1})
+	if !errors.As(err, &tErr) || tErr.Message != "assertion failed" {
+		t.Fatal("incorrect error:", err)
+	}
+
+	_, err = tml.Execute(map[string]int{"size": 1000, "from": 0})
+	if !errors.As(err, &tErr) || tErr.Code != "size_limit" {
+		t.Fatal("incorrect error:", err)
+	}
+	data, _ := json.Marshal(tErr.Data)
+	if string(data) != `{"max":100,"size":1000}` {
+		t.Fatal("incorrect error data:", string(data))
+	}
+
+	//engine errors are not TemplateError
+	tml, err = ParseTemplate(nil, `result = [] result["x"] = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if err == nil || errors.As(err, &tErr) {
+		t.Fatal("expect RuntimeError, got:", err)
+	}
+
+	_, err = ParseTemplate(nil, `fail("code")`)
+	pErr, ok := err.(ParseError)
+	if !ok || pErr.Msg != ErrFailArgs {
+		t.Fatal("expect fail args error, got:", err)
+	}
+}
+
+func TestTemplateReturn(t *testing.T) {
+	code := `
+	def pick(x)
+		if x > 1
+			return "big"
+		end
+		return "small"
+	end
+	result.size = pick(args.size)
+	if !args.filters
+		return {"query": {"match_all": {}}}
+	end
+	for _ f in args.filters
+		if f == "stop"
+			try
+				return result
+			catch
+			end
+		end
+		result.filters[] = f
+	end
+	result.done = true
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args string
+		res  string
+	}{
+		{`{"size": 2}`, `{"query": {"match_all": {}}}`},
+		{`{"size": 1, "filters": ["a", "stop", "b"]}`, `{"size": "small", "filters": ["a"]}`},
+		{`{"size": 1, "filters": ["a"]}`, `{"size": "small", "filters": ["a"], "done": true}`},
+	}
+	for _, test := range tests {
+		res, err := tml.Execute(json.RawMessage(test.args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkExecuteRes(res, test.res)
+		if err != nil {
+			t.Fatal(test.args, err)
+		}
+	}
+}
+
+func TestTemplateLet(t *testing.T) {
+	code := `
+	x = "outer"
+	for _ item in args
+		let obj
+		if item > 1
+			obj.big = true
+		end
+		obj.value = item
+		result.items[] = obj
+		let x = item
+		result.inner[] = x
+	end
+	if true
+		let x = x + "!"
+		result.shadow = x
+	end
+	result.x = x
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute([]int{2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"items": [{"big": true, "value": 2}, {"value": 1}],
+		"inner": [2, 1],
+		"shadow": "outer!",
+		"x": "outer"
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []string{`let result = 1`, `let args`, `for result in args end`, `try catch args end`} {
+		_, err = ParseTemplate(nil, code)
+		pErr, ok := err.(ParseError)
+		if !ok || pErr.Msg != ErrVarName {
+			t.Fatalf("%s: expect var name error, got: %v", code, err)
+		}
+	}
+
+	//vars of block are not visible outside
+	_, err = ParseTemplate(nil, `try fail("a", "b") catch err end result = err`)
+	if err == nil {
+		t.Fatal("expect error for catch var outside of block")
+	}
+
+	//comprehension vars don't change outer vars
+	tml, err = ParseTemplate(nil, `
+	item = 5
+	let k = "k"
+	x = [item for _ item in args if item > 0]
+	y = {k: [item * 10 for _ item in args] for k item in args}
+	result.list = x
+	result.obj = y
+	result.item = item
+	result.k = k
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = tml.Execute([]int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{"list": [1, 2], "obj": {"0": [10, 20], "1": [10, 20]}, "item": 5, "k": "k"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateValueSemantics(t *testing.T) {
+	code := `
+	a = %%{}%%
+	a.x = 1
+	b = a
+	b.y = 2
+	obj = {"n": 0, "tags": []}
+	result.list[] = obj
+	result.list[] = obj
+	result.list[0].n = 1
+	result.list[1].tags[] = "t"
+	for _ item in result.list
+		item.n = 5
+	end
+	def touch(o)
+		o.touched = true
+		return o
+	end
+	result.touched = touch(obj)
+	result.obj = obj
+	result.a = a
+	result.b = b
+	result.args = args
+	result.args.list[] = 3
+	result.merged = {"m": {"k": [1]}}
+	result.merged.m <<= {"k": [2]}
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := map[string]interface{}{"list": []interface{}{1, 2}}
+	res, err := tml.Execute(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"list": [{"n": 1, "tags": []}, {"n": 0, "tags": ["t"]}],
+		"touched": {"n": 0, "tags": [], "touched": true},
+		"obj": {"n": 0, "tags": []},
+		"a": {"x": 1},
+		"b": {"x": 1, "y": 2},
+		"args": {"list": [1, 2, 3]},
+		"merged": {"m": {"k": [1, 2]}}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args["list"].([]interface{})) != 2 {
+		t.Fatal("args are changed:", args)
+	}
+
+	//containers which are not referenced anymore are not kept by vm
+	tml, err = ParseTemplate(nil, `
+	def build(i)
+		let tmp = {"n": 0}
+		tmp.n = i
+		tmp.list[] = i
+		return tmp
+	end
+	for i in range(1000)
+		obj = {"n": 0}
+		obj.n = i
+		obj.inner.list[] = i
+		result.last = build(i)
+	end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := tml.newVm(context.Background(), nil)
+	_, err = v.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.owned) > 10 {
+		t.Fatal("too many owned containers:", len(v.owned))
+	}
+
+	//result which can't be copied is error
+	tml, err = ParseTemplate(nil, `result.a = args`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(map[string]interface{}{"c": make(chan int)})
+	if err == nil {
+		t.Fatal("expect error for result which can't be copied")
+	}
+}
+
+func TestTemplateImmutableInputs(t *testing.T) {
+	opt := NewOptions()
+	err := opt.Const("defaults", map[string]interface{}{
+		"size": 10,
+		"sort": []interface{}{"date"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := `
+	args.query.id = args.id
+	args.tags[] = "new"
+	delete args.id
+	result = defaults
+	result.size = args.size
+	result.sort[] = "id"
+	result.tags = args.tags
+	for _ tag in result.tags
+		tag = tag + "!"
+	end
+	`
+	tml, err := ParseTemplate(opt, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			args := map[string]interface{}{
+				"id":    i,
+				"size":  i,
+				"query": map[string]interface{}{},
+				"tags":  []interface{}{"a"},
+			}
+			res, err := tml.Execute(args)
+			if err != nil {
+				errs <- err
+				return
+			}
+			err = checkExecuteRes(res, fmt.Sprintf(`{"size": %d, "sort": ["date", "id"], "tags": ["a", "new"]}`, i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			data, _ := json.Marshal(args)
+			expect := fmt.Sprintf(`{"id":%d,"query":{},"size":%d,"tags":["a"]}`, i, i)
+			if string(data) != expect {
+				errs <- fmt.Errorf("args are changed: %s", data)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(opt.constants["defaults"])
+	if string(data) != `{"size":10,"sort":["date"]}` {
+		t.Fatal("const is changed:", string(data))
+	}
+}
+
+func TestTemplateUseBeforeAssignment(t *testing.T) {
+	tests := []struct {
+		code string
+		line int
+	}{
+		{"x.a = 1", 1},
+		{"x[] = 1", 1},
+		{"if args.a\n x = 1\nend\nresult = x", 4},
+		{"for _ v in args\n x = v\nend\nresult = x", 4},
+		{"try\n x = args.a\ncatch\nend\nresult = x", 5},
+		{"def f(a)\n if a\n  b = 1\n end\n return b\nend\nresult = f(1)", 5},
+	}
+	for _, test := range tests {
+		_, err := ParseTemplate(nil, test.code)
+		rErr, ok := err.(RuntimeError)
+		if !ok || rErr.Pos.Line() != test.line {
+			t.Fatalf("%q: expect use before assignment error at line %d, got: %v", test.code, test.line, err)
+		}
+	}
+
+	valid := []string{
+		"if args.a\n x = 1\nelse\n x = 2\nend\nresult = x",
+		"x = 0\nfor _ v in args\n x = v\nend\nresult = x",
+		"try\n x = args.a\ncatch\n x = null\nend\nresult = x",
+		"switch args\ncase 1\n x = 1\ndefault\n x = 2\nend\nresult = x",
+	}
+	for _, code := range valid {
+		_, err := ParseTemplate(nil, code)
+		if err != nil {
+			t.Fatalf("%q: %v", code, err)
+		}
+	}
+}
+
+func TestTemplateRuntimeFaults(t *testing.T) {
+	opt := NewOptions()
+	err := opt.Func("double", func(a int) int {
+		return a * 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tml, err := ParseTemplate(opt, `result = double(args.x)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(map[string]interface{}{"x": nil})
+	if _, ok := err.(RuntimeError); !ok {
+		t.Fatal("expect RuntimeError, got:", err)
+	}
+
+	tml, err = ParseTemplate(nil, `result = "empty" if args result = "set" end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(json.RawMessage{})
+	if err != nil || res != "empty" {
+		t.Fatal("incorrect result:", res, err)
+	}
+}
+
+func TestTemplateIsEmpty(t *testing.T) {
+	for data, empty := range map[string]bool{
+		`null`: true, ` false `: true, `0`: true, `""`: true, `0.0`: true, `[]`: true, `{ }`: true,
+		`0.5`: false, `true`: false, `"0"`: false, `"null"`: false, `-1`: false, `[0]`: false, `{"a": null}`: false,
+	} {
+		if isEmpty(reflect.ValueOf(json.RawMessage(data))) != empty {
+			t.Fatalf("%s: expect empty %v", data, empty)
+		}
+	}
+}
+
+func TestTemplateExecuteLimits(t *testing.T) {
+	code := `
+	try
+		for 1
+			result += 1
+		end
+	catch
+		result = "caught"
+	end
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = tml.ExecuteContext(ctx, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expect deadline error, got:", err)
+	}
+	if _, ok := err.(RuntimeError); !ok {
+		t.Fatal("expect RuntimeError, got:", err)
+	}
+
+	tml, err = ParseTemplate(NewOptions().MaxInstructions(1000), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Fatal("expect instruction limit error, got:", err)
+	}
+
+	opt := NewOptions().MaxLoopIterations(10)
+	tml, err = ParseTemplate(opt, `for i in range(10) result[] = i end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tml, err = ParseTemplate(opt, `for i in range(5) for j in range(5) result[] = j end end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if !errors.Is(err, ErrLoopIterationLimit) {
+		t.Fatal("expect loop iteration limit error, got:", err)
+	}
+
+	//iterations with false condition are counted too
+	opt = NewOptions().MaxLoopIterations(100)
+	list := make([]int, 1000)
+	for _, code := range []string{`result = [i for i in range(100000000) if i < 0]`, `result = args[?(@ < 0)]`} {
+		tml, err = ParseTemplate(opt, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err = tml.ExecuteContext(ctx, list)
+		cancel()
+		if !errors.Is(err, ErrLoopIterationLimit) {
+			t.Fatalf("%s: expect loop iteration limit error, got: %v", code, err)
+		}
+	}
+
+	//ranges are expanded by vm with limits
+	tml, err = ParseTemplate(opt, `x = sorted(range(30000000))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if !errors.Is(err, ErrLoopIterationLimit) {
+		t.Fatal("expect loop iteration limit error, got:", err)
+	}
+	tml, err = ParseTemplate(NewOptions().MaxOutputNodes(100), `result.r = range(1000)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if !errors.Is(err, ErrOutputNodesLimit) {
+		t.Fatal("expect output nodes limit error, got:", err)
+	}
+	tml, err = ParseTemplate(nil, `result = range(3)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(nil)
+	if _, isRange := res.(*numRange); isRange || err != nil {
+		t.Fatalf("expect array result, got: %T %v", res, err)
+	}
+	err = checkExecuteRes(res, `[0, 1, 2]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code = `
+	def f(n)
+		if n == 0
+			return 0
+		end
+		return f(n - 1) + 1
+	end
+	result = f(args)
+	`
+	tml, err = ParseTemplate(NewOptions().MaxCallDepth(10), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = tml.Execute(9)
+	if err != nil || fmt.Sprint(res) != "9" {
+		t.Fatal("incorrect result:", res, err)
+	}
+	_, err = tml.Execute(10)
+	if !errors.Is(err, ErrCallDepthLimit) {
+		t.Fatal("expect call depth limit error, got:", err)
+	}
+}
+
+func TestTemplateOutputLimits(t *testing.T) {
+	opt := NewOptions().
+		MaxArrayGap(100).
+		MaxOutputNodes(1000).
+		MaxOutputBytes(10000).
+		MaxStringLength(20).
+		MaxDepth(5)
+	tests := []struct {
+		code string
+		err  error
+		line int
+	}{
+		{"result = []\nresult[1000000000] = 1", ErrArrayGapLimit, 2},
+		{"result = [1]\nresult[-1000000000] = 1", ErrArrayGapLimit, 2},
+		{"result.list[1000000000] = 1", ErrArrayGapLimit, 1},
+		{"for i in range(2000)\n result[] = i\nend", ErrOutputNodesLimit, 2},
+		{"s = \"0123456789\"\nfor i in range(2000)\n result[i % 10] = s\nend", ErrOutputBytesLimit, 3},
+		{"s = \"0123456789\"\ns = s + s + s", ErrStringLengthLimit, 2},
+		{"result.a.b.c = {\"d\": {\"e\": {\"f\": 1}}}", ErrDepthLimit, 1},
+		{"x = [i for i in range(2000)]", ErrOutputNodesLimit, 1},
+		{"result = {\"a\": {\"b\": {\"c\": {\"d\": {\"e\": {\"f\": 1}}}}}}", ErrDepthLimit, 1},
+		{"x = 1\nreturn {\"a\": {\"b\": {\"c\": {\"d\": {\"e\": {\"f\": x}}}}}}", ErrDepthLimit, 2},
+		{"result = range(2000)", ErrOutputNodesLimit, 1},
+	}
+	for _, test := range tests {
+		tml, err := ParseTemplate(opt, test.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tml.Execute(nil)
+		rErr, ok := err.(RuntimeError)
+		if !ok || !errors.Is(err, test.err) || rErr.Pos.Line() != test.line {
+			t.Fatalf("%q: expect %v at line %d, got: %v", test.code, test.err, test.line, err)
+		}
+	}
+
+	tml, err := ParseTemplate(opt, `result = []
+	result[99] = "0123456789"
+	result[-1].a.b = 1
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateIterationOrder(t *testing.T) {
+	code := `
+	for k v in args.obj
+		result.doc[] = k
+	end
+	for k v in args.obj.c
+		result.nested[] = k
+	end
+	for k in sorted(args.obj, true)
+		result.desc[] = k
+	end
+	result.nums = sorted(args.nums)
+	for _ v in sortBy(args.users, "age", true)
+		result.users[] = v.name
+	end
+	result.byName = sortBy(args.users, "name")
+	result.any = args.obj.*
+	`
+	tml, err := ParseTemplate(nil, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := json.RawMessage(`{
+		"obj": {"z": 1, "a": 2, "c": {"y": 1, "b": 2}},
+		"nums": [3, 1.5, 2, "x", null],
+		"users": [{"name": "bob", "age": 20}, {"name": "alice", "age": 30}, {"name": "carl", "age": 20}]
+	}`)
+	res, err := tml.Execute(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{
+		"doc": ["z", "a", "c"],
+		"nested": ["y", "b"],
+		"desc": ["z", "c", "a"],
+		"nums": [null, 1.5, 2, 3, "x"],
+		"users": ["alice", "bob", "carl"],
+		"byName": [{"name": "alice", "age": 30}, {"name": "bob", "age": 20}, {"name": "carl", "age": 20}],
+		"any": [1, 2, {"y": 1, "b": 2}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//empty sorted items and ranges are false
+	tml, err = ParseTemplate(nil, `
+	result = {"sorted": "empty", "range": "empty", "down": "empty"}
+	if sorted([]) result.sorted = "full" end
+	if range(0) result.range = "full" end
+	if range(3, 0, -1) result.down = "full" end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{"sorted": "empty", "range": "empty", "down": "full"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//go maps are iterated in sorted key order
+	tml, err = ParseTemplate(nil, `for k v in args result[] = k end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = tml.Execute(map[string]int{"d": 1, "b": 2, "c": 3, "a": 4, "e": 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(res)
+	if string(data) != `["a","b","c","d","e"]` {
+		t.Fatal("incorrect order:", string(data))
+	}
+}
+
+func TestTemplateOrderedObjects(t *testing.T) {
+	code := `
+	result.obj = args.obj
+	result.obj.b = 5
+	result.obj.new = {"z": 1, "a": 2}
+	delete result.obj.x
+	result.obj.c.y = 3
+	result.obj.c <<= {"k": 1, "b": 2}
+	result.list = {"q": 1, "p": 2}
+	result.list[] = 3
+	result.slice = [0, 0]
+	result.slice[1:] = args.items
+	for k v in result.obj
+		result.keys[] = k
+	end
+	`
+	opt := &Options{}
+	opt.Prototype(json.RawMessage(`{"first": 1, "list": null, "obj": null, "keys": null}`))
+	tml, err := ParseTemplate(opt.OrderedObjects(true), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := json.RawMessage(`{"obj": {"x": 0, "m": 1, "b": 2, "c": {"z": 0}}, "items": [{"y": 1, "a": 2}]}`)
+	res, err := tml.Execute(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"first":1,"list":{"q":1,"p":2,"0":3},` +
+		`"obj":{"m":1,"b":5,"c":{"z":0,"y":3,"k":1,"b":2},"new":{"z":1,"a":2}},` +
+		`"keys":["m","b","c","new"],"slice":[0,{"y":1,"a":2}]}`
+	if string(data) != expected {
+		t.Fatal("incorrect order:", string(data))
+	}
+	if _, ok := res.(*OrderedMap); !ok {
+		t.Fatalf("expected *OrderedMap result, got %T", res)
+	}
+}
+
+func TestTemplateOrderedObjectsBoundaries(t *testing.T) {
+	opt := NewOptions().OrderedObjects(true)
+	err := opt.StringTemplate("tmpl", `{{.name}}:{{index .tags 0}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = opt.Func("kind", func(v interface{}) string {
+		switch tv := v.(type) {
+		case map[string]interface{}:
+			inner, ok := tv["list"].([]interface{})
+			if ok && len(inner) > 0 {
+				if _, ok := inner[0].(map[string]interface{}); ok {
+					return "map"
+				}
+			}
+			return "map with incorrect list"
+		case []interface{}:
+			return "array"
+		}
+		return fmt.Sprintf("%T", v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := `
+	obj = {"name": "", "tags": ["a"], "list": [{"b": 1}]}
+	obj.name = "x"
+	obj.list[0].b = 2
+	result.str = .tmpl(obj)
+	result.obj = kind(obj)
+	result.sorted = kind(sorted(obj))
+	result.range = kind(range(2))
+	`
+	tml, err := ParseTemplate(opt, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tml.Execute(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkExecuteRes(res, `{"str": "x:a", "obj": "map", "sorted": "map", "range": "array"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -24,6 +24,12 @@ const (
 	charNewLine   = 10
 	charSpace     = 32
 	charEqual     = 61
+	charOperator  = 33
+	charHash      = 35
+	charColon     = 58
+	charBracketCO = 123
+	charBracketCC = 125
+	charAt        = 64
 	//charXXXPercent   = 37
 )
 
@@ -53,6 +59,14 @@ func init() {
 	charMap[charPercent] = charPercent
 	charMap[charNewLine] = charNewLine
 	charMap[charEqual] = charEqual
+	charMap[charHash] = charHash
+	charMap[charColon] = charColon
+	charMap[charBracketCO] = charBracketCO
+	charMap[charBracketCC] = charBracketCC
+	charMap[charAt] = charAt
+	for _, c := range "+*/!<>&|?" {
+		charMap[c] = charOperator
+	}
 	charMap[charSpace] = charSpace
 	charMap[9] = charSpace
 	charMap[11] = charSpace
@@ -81,9 +95,59 @@ const (
 	tokenKwIn
 	tokenKwElse
 	tokenKwEnd
+	tokenOperator
+	tokenKwSwitch
+	tokenKwCase
+	tokenKwDefault
+	tokenColon
+	tokenKwBreak
+	tokenKwContinue
+	tokenKwDef
+	tokenKwReturn
+	tokenBracketCO
+	tokenBracketCC
+	tokenKwTrue
+	tokenKwFalse
+	tokenKwNull
+	tokenKwDelete
+	tokenAt
+	tokenKwTry
+	tokenKwCatch
+	tokenKwAssert
+	tokenKwFail
+	tokenKwLet
 )
 
-var tokenTypeNames = []string{"none", "Word", ".", ",", "(", ")", "[", "]", "=", "Num", "String", "Object", "if", "for", "in", "else", "end"}
+var tokenTypeNames = []string{"none", "Word", ".", ",", "(", ")", "[", "]", "=", "Num", "String", "Object", "if", "for", "in", "else", "end", "Operator",
+	"switch", "case", "default", ":", "break", "continue", "def", "return", "{", "}",
+	"true", "false", "null", "delete", "@", "try", "catch", "assert", "fail", "let"}
+
+var keywords = map[string]tokenType{
+	"if":       tokenKwIf,
+	"for":      tokenKwFor,
+	"in":       tokenKwIn,
+	"else":     tokenKwElse,
+	"end":      tokenKwEnd,
+	"switch":   tokenKwSwitch,
+	"case":     tokenKwCase,
+	"default":  tokenKwDefault,
+	"break":    tokenKwBreak,
+	"continue": tokenKwContinue,
+	"def":      tokenKwDef,
+	"return":   tokenKwReturn,
+	"true":     tokenKwTrue,
+	"false":    tokenKwFalse,
+	"null":     tokenKwNull,
+	"delete":   tokenKwDelete,
+	"try":      tokenKwTry,
+	"catch":    tokenKwCatch,
+	"assert":   tokenKwAssert,
+	"fail":     tokenKwFail,
+	"let":      tokenKwLet,
+}
+
+// operators ordered so that longer operators are matched first
+var operators = []string{"<<=", "+=", "-=", "*=", "/=", "%=", "??", "?", "==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "!", "="}
 
 func (t tokenType) String() string {
 	if t >= 0 && int(t) < len(tokenTypeNames) {
@@ -106,6 +170,8 @@ const (
 	tokenizerStateNumber
 	tokenizerStateString
 	tokenizerStateObject
+	tokenizerStateLineComment
+	tokenizerStateBlockComment
 )
 
 func tokenize(data []byte) ([]token, error) {
@@ -132,6 +198,8 @@ type tokenizer struct {
 	tokenStart Position
 	dataStart  Position
 	objQuote   []byte
+	brackets   int   //nesting level of round brackets
+	filters    []int //round brackets levels of opened path filters `[?(...)]`
 }
 
 func (t *tokenizer) walk() error {
@@ -155,6 +223,10 @@ func (t *tokenizer) walk() error {
 		t.walkIfStateString()
 	case tokenizerStateObject:
 		t.walkIfStateObject()
+	case tokenizerStateLineComment:
+		t.walkIfStateLineComment()
+	case tokenizerStateBlockComment:
+		t.walkIfStateBlockComment()
 	}
 
 	return nil
@@ -181,6 +253,11 @@ func (t *tokenizer) onDataEnd() error {
 			Msg: ErrUnexpectedObjEnd,
 			Pos: t.tokenStart,
 		}
+	case tokenizerStateBlockComment:
+		return ParseError{
+			Msg: ErrUnexpectedCommentEnd,
+			Pos: t.tokenStart,
+		}
 	}
 	return io.EOF
 }
@@ -193,19 +270,8 @@ func (t *tokenizer) closeWord() {
 		end:   t.cur,
 	}
 
-	if len(ct.data) < 5 {
-		switch string(ct.data) {
-		case "if":
-			ct.token = tokenKwIf
-		case "for":
-			ct.token = tokenKwFor
-		case "in":
-			ct.token = tokenKwIn
-		case "else":
-			ct.token = tokenKwElse
-		case "end":
-			ct.token = tokenKwEnd
-		}
+	if kw, ok := keywords[string(ct.data)]; ok {
+		ct.token = kw
 	}
 	t.tokens = append(t.tokens, ct)
 	t.state = tokenizerStateNone
@@ -245,14 +311,39 @@ func (t *tokenizer) walkIfStateNone() error {
 	case charLater:
 		t.tokenStart = t.cur
 		t.state = tokenizerStateWord
-	case charMinus, charNum:
+	case charMinus:
+		//`-` before digit always starts number, parser split it if binary operator expected
+		if !t.nextIs(charNum) {
+			return t.readOperator()
+		}
+		t.tokenStart = t.cur
+		t.state = tokenizerStateNumber
+	case charNum:
 		t.tokenStart = t.cur
 		t.state = tokenizerStateNumber
 	case charQuote:
 		t.tokenStart = t.cur
 		t.state = tokenizerStateString
 	case charPercent:
+		//modulo operator should be followed by space, `(` or `=`
+		if t.nextIs(charSpace) || t.nextIs(charNewLine) || t.nextIs(charBracketRO) || t.nextIs(charEqual) {
+			return t.readOperator()
+		}
 		return t.openObject()
+	case charHash:
+		t.state = tokenizerStateLineComment
+	case charOperator, charEqual:
+		switch {
+		case bytes.HasPrefix(t.data[t.cur.offset:], []byte("//")):
+			t.state = tokenizerStateLineComment
+		case bytes.HasPrefix(t.data[t.cur.offset:], []byte("/*")):
+			t.tokenStart = t.cur
+			t.state = tokenizerStateBlockComment
+			t.cur.inc(2)
+			return nil
+		default:
+			return t.readOperator()
+		}
 	case charDot:
 		t.tokens = append(t.tokens, token{
 			token: tokenDot,
@@ -263,21 +354,37 @@ func (t *tokenizer) walkIfStateNone() error {
 			token: tokenComa,
 			start: t.cur,
 		})
-	case charEqual:
-		t.tokens = append(t.tokens, token{
-			token: tokenEqual,
-			start: t.cur,
-		})
 	case charBracketRO:
+		if t.isFilterStart() {
+			t.filters = append(t.filters, t.brackets)
+		}
+		t.brackets++
 		t.tokens = append(t.tokens, token{
 			token: tokenBracketRO,
 			start: t.cur,
 		})
 	case charBracketRC:
+		t.brackets--
+		if len(t.filters) > 0 && t.filters[len(t.filters)-1] == t.brackets {
+			t.filters = t.filters[:len(t.filters)-1]
+		}
 		t.tokens = append(t.tokens, token{
 			token: tokenBracketRC,
 			start: t.cur,
 		})
+	case charAt:
+		//`@` is current element of path filter, it is not allowed outside of filter
+		if len(t.filters) == 0 {
+			return ParseError{
+				Msg: ErrUnexpectedSymbol,
+				Pos: t.cur,
+			}
+		}
+		t.tokens = append(t.tokens, token{
+			token: tokenAt,
+			data:  t.data[t.cur.offset : t.cur.offset+1],
+			start: t.cur,
+		})
 	case charBracketSO:
 		t.tokens = append(t.tokens, token{
 			token: tokenBracketSO,
@@ -288,6 +395,21 @@ func (t *tokenizer) walkIfStateNone() error {
 			token: tokenBracketSC,
 			start: t.cur,
 		})
+	case charColon:
+		t.tokens = append(t.tokens, token{
+			token: tokenColon,
+			start: t.cur,
+		})
+	case charBracketCO:
+		t.tokens = append(t.tokens, token{
+			token: tokenBracketCO,
+			start: t.cur,
+		})
+	case charBracketCC:
+		t.tokens = append(t.tokens, token{
+			token: tokenBracketCC,
+			start: t.cur,
+		})
 	case charNewLine:
 		t.cur.line++
 		t.cur.column = -1
@@ -297,6 +419,43 @@ func (t *tokenizer) walkIfStateNone() error {
 	return nil
 }
 
+// isFilterStart checks that last tokens are `[?`
+func (t *tokenizer) isFilterStart() bool {
+	n := len(t.tokens)
+	return n >= 2 && t.tokens[n-2].token == tokenBracketSO &&
+		t.tokens[n-1].token == tokenOperator && string(t.tokens[n-1].data) == "?"
+}
+
+func (t *tokenizer) nextIs(ct byte) bool {
+	next := t.cur.offset + 1
+	return next < len(t.data) && charMap[t.data[next]] == ct
+}
+
+func (t *tokenizer) readOperator() error {
+	data := t.data[t.cur.offset:]
+	for _, op := range operators {
+		if !bytes.HasPrefix(data, []byte(op)) {
+			continue
+		}
+		ct := token{
+			token: tokenOperator,
+			data:  data[:len(op)],
+			start: t.cur,
+		}
+		if op == "=" {
+			ct.token = tokenEqual
+		}
+		t.cur.inc(len(op))
+		ct.end = t.cur
+		t.tokens = append(t.tokens, ct)
+		return nil
+	}
+	return ParseError{
+		Msg: ErrUnexpectedSymbol,
+		Pos: t.cur,
+	}
+}
+
 func (t *tokenizer) openObject() error {
 	t.tokenStart = t.cur
 	t.state = tokenizerStateObject
@@ -395,3 +554,26 @@ func (t *tokenizer) walkIfStateObject() {
 
 	t.cur.inc(1)
 }
+
+func (t *tokenizer) walkIfStateLineComment() {
+	char := t.data[t.cur.offset]
+	if charMap[char] == charNewLine {
+		//new line is processed in none state to track position
+		t.state = tokenizerStateNone
+		return
+	}
+	t.cur.inc(1)
+}
+
+func (t *tokenizer) walkIfStateBlockComment() {
+	if bytes.HasPrefix(t.data[t.cur.offset:], []byte("*/")) {
+		t.cur.inc(2)
+		t.state = tokenizerStateNone
+		return
+	}
+	if charMap[t.data[t.cur.offset]] == charNewLine {
+		t.cur.line++
+		t.cur.column = -1
+	}
+	t.cur.inc(1)
+}
@@ -322,3 +322,96 @@ func TestTokenize14(t *testing.T) {
 		t.Fatal("Incorrect token position", pos)
 	}
 }
+
+func TestTokenizeOperators(t *testing.T) {
+	data := `a+1 <= -2 && !b || c % (d-3) != e`
+	tokens, err := tokenize([]byte(data))
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	expect := []string{"a", "+", "1", "<=", "-2", "&&", "!", "b", "||", "c", "%", "(", "d", "-3", ")", "!=", "e"}
+	if len(tokens) != len(expect) {
+		t.Fatalf("len(tokens) = %d ", len(tokens))
+	}
+	for i, tk := range tokens {
+		if tk.token == tokenBracketRO || tk.token == tokenBracketRC {
+			continue
+		}
+		if string(tk.data) != expect[i] {
+			t.Fatalf("token %d content: %s", i, tk.data)
+		}
+	}
+	if tokens[1].token != tokenOperator || tokens[4].token != tokenNum || tokens[10].token != tokenOperator {
+		t.Fatal("incorrect token type")
+	}
+}
+
+func TestTokenizeUpdateOperators(t *testing.T) {
+	data := `a += 1 b -= 2 c *= 3 d /= 4 e %= 5 f <<= g`
+	tokens, err := tokenize([]byte(data))
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	if len(tokens) != 18 {
+		t.Fatalf("len(tokens) = %d ", len(tokens))
+	}
+	for i, op := range []string{"+=", "-=", "*=", "/=", "%=", "<<="} {
+		tk := tokens[i*3+1]
+		if tk.token != tokenOperator || string(tk.data) != op {
+			t.Fatalf("token %d content: %s", i*3+1, tk.data)
+		}
+	}
+}
+
+func TestTokenizeComments(t *testing.T) {
+	data := `x = 1 # line comment
+	// another comment
+	/* block
+	comment */ y = a / b`
+	tokens, err := tokenize([]byte(data))
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	if len(tokens) != 8 {
+		t.Fatalf("len(tokens) = %d ", len(tokens))
+	}
+	pos := tokens[3].start
+	if string(tokens[3].data) != "y" || pos.line != 4 || pos.column != 12 {
+		t.Fatal("Incorrect token position", pos)
+	}
+	if string(tokens[6].data) != "/" {
+		t.Fatal("token 6 content")
+	}
+
+	_, err = tokenize([]byte("x = 1 /* comment"))
+	pErr, ok := err.(ParseError)
+	if !ok {
+		t.Fatalf("err type %T != ParseError", err)
+	}
+	if pErr.Msg != ErrUnexpectedCommentEnd {
+		t.Fatal("err msg:", pErr.Msg)
+	}
+}
+
+func TestTokenizeFilter(t *testing.T) {
+	data := `x[?(f(@) && @.a)] y`
+	tokens, err := tokenize([]byte(data))
+	if err != nil {
+		t.Fatalf("err=%v", err)
+	}
+	if len(tokens) != 15 {
+		t.Fatalf("len(tokens) = %d ", len(tokens))
+	}
+	if tokens[6].token != tokenAt || tokens[9].token != tokenAt {
+		t.Fatal("incorrect token type")
+	}
+
+	_, err = tokenize([]byte(`x[?(@.a)] @`))
+	pErr, ok := err.(ParseError)
+	if !ok {
+		t.Fatalf("err type %T != ParseError", err)
+	}
+	if pErr.Msg != ErrUnexpectedSymbol || pErr.Pos.column != 10 {
+		t.Fatal("err:", pErr)
+	}
+}
@@ -2,7 +2,9 @@ package json_template
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 )
@@ -10,8 +12,45 @@ import (
 type vm struct {
 	data      [2][]reflect.Value
 	functions []reflect.Value
+	external  []bool
+	defs      []vmDef
 	code      []vmCmd
 	ptr       int
+	frames    []vmFrame
+	handlers  []vmHandler
+	ctx       context.Context
+	limits    limits
+	steps     int //executed instructions
+	loops     int //loop iterations (backward jumps)
+	nodes     int //json values written to containers
+	bytes     int //approximate json size of written values
+	ordered   bool
+
+	//containers (objects and arrays) referenced only from one place, they can be changed in place,
+	//other containers are copied before change; values keep containers from reuse of address,
+	//entries are dropped when container is shared, overwritten or removed
+	owned map[uintptr]interface{}
+}
+
+// vmDef describes template-defined function
+type vmDef struct {
+	name     string
+	entry    int
+	dataSize int
+}
+
+// vmFrame keeps caller state during template-defined function call
+type vmFrame struct {
+	data   []reflect.Value
+	ret    int
+	target int
+}
+
+// vmHandler is error handler of `try` block
+type vmHandler struct {
+	catch  int
+	target int //error var, -1 if error is not used
+	frames int
 }
 
 type vmCmdType int
@@ -21,6 +60,10 @@ const (
 	vmCmdJmp
 	vmCmdJmpIfEmpty
 	vmCmdJmpIfNotEmpty
+	vmCmdCallDef
+	vmCmdRet
+	vmCmdTry
+	vmCmdTryEnd
 
 	//virtual cmd: used before build final code
 	opCmdLabel
@@ -28,7 +71,8 @@ const (
 	opCmdConst
 )
 
-var vmCmdTypeNames = []string{"call", "jmp", "jmpIfEmpty", "kmpIfNotEmpty", "label", "tmpVarFree", "const"}
+var vmCmdTypeNames = []string{"call", "jmp", "jmpIfEmpty", "kmpIfNotEmpty", "callDef", "ret",
+	"try", "tryEnd", "label", "tmpVarFree", "const"}
 
 func (t vmCmdType) String() string {
 	if t >= 0 && int(t) < len(vmCmdTypeNames) {
@@ -51,18 +95,152 @@ type vmFnArg struct {
 
 func (v *vm) run() (interface{}, error) {
 	for v.ptr < len(v.code) {
-		err := v.doCmd()
+		err := v.exec()
 		if err != nil {
-			return nil, RuntimeError{
+			pos := v.code[v.ptr].codePos
+			var tErr TemplateError
+			if errors.As(err, &tErr) {
+				tErr.Pos = pos
+				err = tErr
+			}
+			rErr := RuntimeError{
 				Err: err,
-				Pos: v.code[v.ptr].codePos,
+				Pos: pos,
+			}
+			if len(v.handlers) > 0 && !isStopError(err) {
+				v.catch(rErr)
+				continue
+			}
+			if errors.As(err, &tErr) {
+				return nil, tErr
+			}
+			return nil, rErr
+		}
+	}
+	res, err := v.materialize(v.data[1][0].Interface())
+	if err == nil {
+		res, err = v.detach(res)
+	}
+	if err != nil {
+		return nil, RuntimeError{Err: err, Pos: v.code[len(v.code)-1].codePos}
+	}
+	return res, nil
+}
+
+// detach copies shared containers of result, so result doesn't reference args, consts
+// or other parts of itself
+func (v *vm) detach(val interface{}) (interface{}, error) {
+	ptr := containerPtr(val)
+	if ptr == 0 {
+		return val, nil
+	}
+	if _, ok := v.owned[ptr]; !ok {
+		return clone(val)
+	}
+	var err error
+	switch tv := val.(type) {
+	case map[string]interface{}:
+		for key, item := range tv {
+			tv[key], err = v.detach(item)
+			if err != nil {
+				return nil, err
 			}
 		}
+	case []interface{}:
+		for i, item := range tv {
+			tv[i], err = v.detach(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case *OrderedMap:
+		for key, item := range tv.values {
+			tv.values[key], err = v.detach(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return val, nil
+}
+
+// exec runs code until the end or the first error, panic is returned as error
+func (v *vm) exec() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("runtime panic: %v", r)
+		}
+	}()
+	for v.ptr < len(v.code) {
+		err = v.doCmd()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isStopError reports that error stops execution and can't be caught by `try` block
+func isStopError(err error) bool {
+	for _, stopErr := range []error{ErrInstructionLimit, ErrLoopIterationLimit, ErrCallDepthLimit,
+		ErrArrayGapLimit, ErrOutputNodesLimit, ErrOutputBytesLimit, ErrStringLengthLimit, ErrDepthLimit,
+		context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, stopErr) {
+			return true
+		}
 	}
-	return v.data[1][0].Interface(), nil
+	return false
 }
 
+// catch passes error to the last `try` handler
+func (v *vm) catch(err RuntimeError) {
+	h := v.handlers[len(v.handlers)-1]
+	v.handlers = v.handlers[:len(v.handlers)-1]
+	if len(v.frames) > h.frames {
+		v.releaseData(v.data[1])
+		for _, frame := range v.frames[h.frames+1:] {
+			v.releaseData(frame.data)
+		}
+		v.data[1] = v.frames[h.frames].data
+		v.frames = v.frames[:h.frames]
+	}
+	if h.target >= 0 {
+		v.setData(h.target, reflect.ValueOf(errorValue(err)))
+	}
+	v.ptr = h.catch
+}
+
+// errorValue converts error to object available in `catch` block
+func errorValue(err RuntimeError) map[string]interface{} {
+	res := map[string]interface{}{
+		"message": err.Err.Error(),
+		"line":    err.Pos.line,
+		"column":  err.Pos.column,
+	}
+	if tErr, ok := err.Err.(TemplateError); ok {
+		res["message"] = tErr.Message
+		res["code"] = tErr.Code
+		res["data"] = tErr.Data
+	}
+	return res
+}
+
+// ctxCheckPeriod is number of instructions between checks of context
+const ctxCheckPeriod = 1024
+
 func (v *vm) doCmd() error {
+	v.steps++
+	if v.limits.maxInstructions > 0 && v.steps > v.limits.maxInstructions {
+		return ErrInstructionLimit
+	}
+	if v.steps%ctxCheckPeriod == 0 && v.ctx != nil {
+		select {
+		case <-v.ctx.Done():
+			return v.ctx.Err()
+		default:
+		}
+	}
+
 	cmd := v.code[v.ptr]
 	switch cmd.cmd {
 	case vmCmdCall:
@@ -71,45 +249,170 @@ func (v *vm) doCmd() error {
 			return err
 		}
 	case vmCmdJmp:
-		v.ptr = cmd.target
-		return nil
+		return v.jump(cmd.target)
 	case vmCmdJmpIfEmpty:
 		vPtr := cmd.fnArgs[0]
 		if isEmpty(v.data[vPtr.isVar][vPtr.dataId]) {
-			v.ptr = cmd.target
-			return nil
+			return v.jump(cmd.target)
 		}
 	case vmCmdJmpIfNotEmpty:
 		vPtr := cmd.fnArgs[0]
 		if !isEmpty(v.data[vPtr.isVar][vPtr.dataId]) {
-			v.ptr = cmd.target
-			return nil
+			return v.jump(cmd.target)
+		}
+	case vmCmdCallDef:
+		return v.cmdCallDef(cmd)
+	case vmCmdRet:
+		v.cmdRet(cmd)
+		return nil
+	case vmCmdTry:
+		h := vmHandler{
+			catch:  cmd.target,
+			target: -1,
+			frames: len(v.frames),
+		}
+		if len(cmd.fnArgs) > 0 {
+			h.target = cmd.fnArgs[0].dataId
 		}
+		v.handlers = append(v.handlers, h)
+	case vmCmdTryEnd:
+		v.handlers = v.handlers[:len(v.handlers)-1]
 	}
 
 	v.ptr++
 	return nil
 }
 
+// jump moves to target, backward jump is counted as loop iteration
+func (v *vm) jump(target int) error {
+	if target <= v.ptr {
+		v.loops++
+		if v.limits.maxLoopIterations > 0 && v.loops > v.limits.maxLoopIterations {
+			return ErrLoopIterationLimit
+		}
+	}
+	v.ptr = target
+	return nil
+}
+
 func (v *vm) cmdCall(cmd vmCmd) error {
 	var err error
 	fn := v.functions[cmd.fn]
 	typ := fn.Type()
-	args := make([]reflect.Value, len(cmd.fnArgs))
+	offset := 0
+	if withVm(typ) {
+		offset = 1
+	}
+	args := make([]reflect.Value, len(cmd.fnArgs)+offset)
+	if offset > 0 {
+		args[0] = reflect.ValueOf(v)
+	}
 	for i, ptr := range cmd.fnArgs {
-		args[i], err = v.callArg(ptr, v.fnArgType(typ, i))
+		argTyp := v.fnArgType(typ, i+offset)
+		args[i+offset], err = v.callArg(ptr, argTyp)
 		if err != nil {
 			return err
 		}
+		if v.external[cmd.fn] && argTyp.Kind() == reflect.Interface && argTyp.NumMethod() == 0 {
+			plain, err := v.plain(args[i+offset].Interface())
+			if err != nil {
+				return err
+			}
+			if plain != nil {
+				args[i+offset] = reflect.ValueOf(plain)
+			}
+		}
 	}
 	res, err := safeCall(fn, args)
 	if err != nil {
 		return err
 	}
-	v.data[1][cmd.target] = res
+	v.setData(cmd.target, res)
 	return nil
 }
 
+// setData writes register of current frame, ownership of overwritten container is dropped
+func (v *vm) setData(target int, val reflect.Value) {
+	old := v.data[1][target]
+	v.data[1][target] = val
+	if old.IsValid() && val.IsValid() {
+		v.drop(old.Interface(), val.Interface())
+	}
+}
+
+// drop releases old value replaced by val
+func (v *vm) drop(old, val interface{}) {
+	if containerPtr(old) != containerPtr(val) {
+		v.release(old)
+	}
+}
+
+// releaseData drops ownership of containers of discarded function frame
+func (v *vm) releaseData(data []reflect.Value) {
+	for _, val := range data {
+		if val.IsValid() {
+			v.release(val.Interface())
+		}
+	}
+}
+
+func (v *vm) cmdCallDef(cmd vmCmd) error {
+	if v.limits.maxCallDepth > 0 && len(v.frames) >= v.limits.maxCallDepth {
+		return ErrCallDepthLimit
+	}
+	def := v.defs[cmd.fn]
+	data := make([]reflect.Value, def.dataSize)
+	for i, ptr := range cmd.fnArgs {
+		data[i] = v.data[ptr.isVar][ptr.dataId]
+		if data[i].IsValid() {
+			v.share(data[i].Interface())
+		}
+	}
+	v.frames = append(v.frames, vmFrame{
+		data:   v.data[1],
+		ret:    v.ptr + 1,
+		target: cmd.target,
+	})
+	v.data[1] = data
+	v.ptr = def.entry
+	return nil
+}
+
+func (v *vm) cmdRet(cmd vmCmd) {
+	if len(v.frames) == 0 {
+		//end of main code
+		v.ptr = len(v.code)
+		return
+	}
+	//drop handlers of `try` blocks inside function
+	for len(v.handlers) > 0 && v.handlers[len(v.handlers)-1].frames == len(v.frames) {
+		v.handlers = v.handlers[:len(v.handlers)-1]
+	}
+	ptr := cmd.fnArgs[0]
+	res := v.data[ptr.isVar][ptr.dataId]
+	//result is kept owned, other containers of function are garbage
+	resOwned := false
+	if res.IsValid() {
+		resPtr := containerPtr(res.Interface())
+		_, resOwned = v.owned[resPtr]
+		delete(v.owned, resPtr)
+	}
+	v.releaseData(v.data[1])
+	if resOwned {
+		v.own(res.Interface())
+	}
+	frame := v.frames[len(v.frames)-1]
+	v.frames = v.frames[:len(v.frames)-1]
+	v.data[1] = frame.data
+	v.setData(frame.target, res)
+	v.ptr = frame.ret
+}
+
+// withVm reports that build in function gets vm as the first argument
+func withVm(typ reflect.Type) bool {
+	return typ.NumIn() > 0 && typ.In(0) == vmPtrType
+}
+
 func (v *vm) fnArgType(typ reflect.Type, i int) reflect.Type {
 	lastArg := typ.NumIn() - 1
 	if typ.IsVariadic() && i >= lastArg {
@@ -121,15 +424,34 @@ func (v *vm) fnArgType(typ reflect.Type, i int) reflect.Type {
 
 func (v *vm) callArg(ptr vmFnArg, typ reflect.Type) (reflect.Value, error) {
 	arg := v.data[ptr.isVar][ptr.dataId]
+	if !arg.IsValid() {
+		return arg, errors.New("variable is not set")
+	}
 	argTyp := arg.Type()
 	if argTyp.AssignableTo(typ) {
 		return arg, nil
 	}
 	if argTyp.Kind() == reflect.Interface {
 		arg = arg.Elem()
+		if !arg.IsValid() {
+			return arg, fmt.Errorf("incorect arg type, expect: %s got: null", typ)
+		}
 		argTyp = arg.Type()
 	}
 
+	switch arg.Interface().(type) {
+	case *OrderedMap, *orderedItems, *numRange:
+		plain, err := v.plain(arg.Interface())
+		if err != nil {
+			return arg, err
+		}
+		data, err := json.Marshal(plain)
+		if err != nil {
+			return arg, fmt.Errorf("convert arg error: %v", err)
+		}
+		arg = reflect.ValueOf(json.RawMessage(data))
+		argTyp = rawMsgType
+	}
 	if argTyp == rawMsgType {
 		rv := reflect.New(typ)
 		rm := arg.Interface().(json.RawMessage)
@@ -164,7 +486,392 @@ func safeCall(fun reflect.Value, args []reflect.Value) (val reflect.Value, err e
 	return ret[0], nil
 }
 
+// containerPtr returns address of object or array, 0 for other values
+func containerPtr(val interface{}) uintptr {
+	switch tv := val.(type) {
+	case map[string]interface{}:
+		return reflect.ValueOf(tv).Pointer()
+	case []interface{}:
+		if cap(tv) == 0 {
+			//nothing can be changed in place
+			return 0
+		}
+		return reflect.ValueOf(tv).Pointer()
+	case *OrderedMap:
+		return reflect.ValueOf(tv).Pointer()
+	}
+	return 0
+}
+
+// own marks container as referenced only from one place
+func (v *vm) own(val interface{}) interface{} {
+	ptr := containerPtr(val)
+	if ptr == 0 {
+		return val
+	}
+	if v.owned == nil {
+		v.owned = map[uintptr]interface{}{}
+	}
+	v.owned[ptr] = val
+	return val
+}
+
+// share marks container as referenced from more than one place,
+// its items can't be changed in place too: container is copied before change
+func (v *vm) share(val interface{}) interface{} {
+	v.release(val)
+	return val
+}
+
+// release drops ownership of container and of its owned items,
+// it is used for shared containers and for containers which are not referenced anymore,
+// so registry doesn't keep garbage alive
+func (v *vm) release(val interface{}) {
+	ptr := containerPtr(val)
+	if ptr == 0 {
+		return
+	}
+	if _, ok := v.owned[ptr]; !ok {
+		return
+	}
+	delete(v.owned, ptr)
+	switch tv := val.(type) {
+	case map[string]interface{}:
+		for _, item := range tv {
+			v.release(item)
+		}
+	case []interface{}:
+		for _, item := range tv {
+			v.release(item)
+		}
+	case *OrderedMap:
+		for _, item := range tv.values {
+			v.release(item)
+		}
+	}
+}
+
+// replace moves ownership from old container to its changed version
+func (v *vm) replace(old, val interface{}) interface{} {
+	delete(v.owned, containerPtr(old))
+	return v.own(val)
+}
+
+// writable returns container which can be changed in place: val itself if it is owned, otherwise its copy.
+// Items of copied container become shared.
+func (v *vm) writable(val interface{}) interface{} {
+	ptr := containerPtr(val)
+	if ptr == 0 {
+		return val
+	}
+	if _, ok := v.owned[ptr]; ok {
+		return val
+	}
+	switch tv := val.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(tv))
+		for key, item := range tv {
+			res[key] = v.share(item)
+		}
+		return v.own(res)
+	case []interface{}:
+		res := make([]interface{}, len(tv))
+		for i, item := range tv {
+			res[i] = v.share(item)
+		}
+		return v.own(res)
+	case *OrderedMap:
+		res := tv.copy()
+		for _, item := range res.values {
+			v.share(item)
+		}
+		return v.own(res)
+	}
+	return val
+}
+
+// jsonValue converts val to json types, new containers are owned
+func (v *vm) jsonValue(val interface{}) (interface{}, error) {
+	switch tv := val.(type) {
+	case map[string]interface{}, []interface{}, *OrderedMap:
+		return val, nil
+	case nil, string, bool, int, float64:
+	case json.RawMessage:
+		if v.ordered {
+			return v.orderedValue(tv)
+		}
+	default:
+		if _, ok := jsonNumber(val); v.ordered && !ok {
+			data, err := json.Marshal(val)
+			if err != nil {
+				return nil, err
+			}
+			return v.orderedValue(data)
+		}
+	}
+	res, err := jsonValue(val)
+	if err != nil {
+		return nil, err
+	}
+	return v.own(res), nil
+}
+
+// plain converts OrderedMap, sorted items and ranges to map[string]interface{} and []interface{},
+// it is used for values passed outside of template (Go functions and string templates),
+// containers are copied only if they have values to convert
+func (v *vm) plain(val interface{}) (interface{}, error) {
+	res, _, err := v.plainValue(val)
+	return res, err
+}
+
+// plainValue is plain, second value is false if val is returned as is
+func (v *vm) plainValue(val interface{}) (interface{}, bool, error) {
+	switch tv := val.(type) {
+	case *numRange:
+		arr, err := v.materialize(tv)
+		if err != nil {
+			return nil, false, err
+		}
+		return arr, true, nil
+	case *OrderedMap:
+		res, _, err := v.plainValue(tv.items())
+		return res, true, err
+	case *orderedItems:
+		if !tv.isObject {
+			res, _, err := v.plainValue(append([]interface{}{}, tv.values...))
+			return res, true, err
+		}
+		res := make(map[string]interface{}, len(tv.keys))
+		for i, key := range tv.keys {
+			item, _, err := v.plainValue(tv.values[i])
+			if err != nil {
+				return nil, false, err
+			}
+			res[key] = item
+		}
+		return res, true, nil
+	case map[string]interface{}:
+		var res map[string]interface{}
+		for key, item := range tv {
+			p, changed, err := v.plainValue(item)
+			if err != nil {
+				return nil, false, err
+			}
+			if changed && res == nil {
+				res = make(map[string]interface{}, len(tv))
+				for k, i := range tv {
+					res[k] = i
+				}
+			}
+			if changed {
+				res[key] = p
+			}
+		}
+		if res == nil {
+			return val, false, nil
+		}
+		return res, true, nil
+	case []interface{}:
+		var res []interface{}
+		for i, item := range tv {
+			p, changed, err := v.plainValue(item)
+			if err != nil {
+				return nil, false, err
+			}
+			if changed && res == nil {
+				res = append([]interface{}{}, tv...)
+			}
+			if changed {
+				res[i] = p
+			}
+		}
+		if res == nil {
+			return val, false, nil
+		}
+		return res, true, nil
+	}
+	return val, false, nil
+}
+
+// orderedValue decodes json with objects as OrderedMap, new containers are owned
+func (v *vm) orderedValue(data []byte) (interface{}, error) {
+	res, err := decodeOrdered(data)
+	if err != nil {
+		return nil, err
+	}
+	return v.own(res), nil
+}
+
+// materialize converts lazy range to array, other values are returned as is
+func (v *vm) materialize(val interface{}) (interface{}, error) {
+	r, ok := val.(*numRange)
+	if !ok {
+		return val, nil
+	}
+	if v.limits.maxOutputNodes > 0 && r.len() > v.limits.maxOutputNodes {
+		return nil, ErrOutputNodesLimit
+	}
+	res := []interface{}{}
+	src := r.source()
+	for src.next() {
+		//every item is counted as loop iteration
+		v.loops++
+		if v.limits.maxLoopIterations > 0 && v.loops > v.limits.maxLoopIterations {
+			return nil, ErrLoopIterationLimit
+		}
+		if len(res)%ctxCheckPeriod == 0 && v.ctx != nil {
+			select {
+			case <-v.ctx.Done():
+				return nil, v.ctx.Err()
+			default:
+			}
+		}
+		res = append(res, src.value())
+	}
+	return v.own(res), nil
+}
+
+// storeValue prepares value written at depth: lazy range is converted to array, limits are checked
+func (v *vm) storeValue(val interface{}, depth int) (interface{}, error) {
+	val, err := v.materialize(val)
+	if err != nil {
+		return nil, err
+	}
+	return val, v.checkValue(val, depth)
+}
+
+// checkValue checks limits for value written at depth, and counts it as output
+func (v *vm) checkValue(val interface{}, depth int) error {
+	l := v.limits
+	if l.maxOutputNodes == 0 && l.maxOutputBytes == 0 && l.maxStringLength == 0 && l.maxDepth == 0 {
+		return nil
+	}
+	var m jsonMeasure
+	err := m.measure(val, depth, l.maxStringLength)
+	if err != nil {
+		return err
+	}
+	if l.maxDepth > 0 && m.depth > l.maxDepth {
+		return ErrDepthLimit
+	}
+	return v.count(m.nodes, m.bytes)
+}
+
+// checkGap checks limit of nulls added to array, they are counted as output
+func (v *vm) checkGap(gap int) error {
+	if gap <= 0 {
+		return nil
+	}
+	if v.limits.maxArrayGap > 0 && gap > v.limits.maxArrayGap {
+		return ErrArrayGapLimit
+	}
+	return v.count(gap, gap*len("null,"))
+}
+
+// checkString checks length of string created by template
+func (v *vm) checkString(s string) error {
+	if v.limits.maxStringLength > 0 && len(s) > v.limits.maxStringLength {
+		return ErrStringLengthLimit
+	}
+	return nil
+}
+
+func (v *vm) count(nodes, bytes int) error {
+	v.nodes += nodes
+	v.bytes += bytes
+	if v.limits.maxOutputNodes > 0 && v.nodes > v.limits.maxOutputNodes {
+		return ErrOutputNodesLimit
+	}
+	if v.limits.maxOutputBytes > 0 && v.bytes > v.limits.maxOutputBytes {
+		return ErrOutputBytesLimit
+	}
+	return nil
+}
+
+// jsonMeasure is number of nodes, approximate json size and max depth of value
+type jsonMeasure struct {
+	nodes, bytes, depth int
+}
+
+func (m *jsonMeasure) measure(val interface{}, depth, maxStringLength int) error {
+	m.nodes++
+	if depth > m.depth {
+		m.depth = depth
+	}
+	switch tv := val.(type) {
+	case string:
+		if maxStringLength > 0 && len(tv) > maxStringLength {
+			return ErrStringLengthLimit
+		}
+		m.bytes += len(tv) + 2
+	case json.RawMessage:
+		m.bytes += len(tv)
+		m.measureRaw(tv, depth)
+	case map[string]interface{}:
+		m.bytes += 2
+		for key, item := range tv {
+			m.bytes += len(key) + 4
+			err := m.measure(item, depth+1, maxStringLength)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		m.bytes += 2
+		for _, item := range tv {
+			m.bytes++
+			err := m.measure(item, depth+1, maxStringLength)
+			if err != nil {
+				return err
+			}
+		}
+	case *OrderedMap:
+		m.bytes += 2
+		for key, item := range tv.values {
+			m.bytes += len(key) + 4
+			err := m.measure(item, depth+1, maxStringLength)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		m.bytes += 8
+	}
+	return nil
+}
+
+// measureRaw estimates number of nodes and depth of json without decoding
+func (m *jsonMeasure) measureRaw(data []byte, depth int) {
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+			if depth > m.depth {
+				m.depth = depth
+			}
+			m.nodes++
+		case c == '}' || c == ']':
+			depth--
+		case c == ',':
+			m.nodes++
+		}
+	}
+}
+
 var nilVal reflect.Value
+var vmPtrType = reflect.TypeOf(&vm{})
 var rawMsgType = reflect.TypeOf(json.RawMessage{})
 
 func isEmpty(val reflect.Value) bool {
@@ -177,6 +884,14 @@ func isEmpty(val reflect.Value) bool {
 			return true
 		}
 	}
+	switch tv := val.Interface().(type) {
+	case *OrderedMap:
+		return tv == nil || tv.Len() == 0
+	case *orderedItems:
+		return tv == nil || len(tv.values) == 0
+	case *numRange:
+		return tv == nil || !tv.source().next()
+	}
 
 	switch val.Kind() {
 	case reflect.Slice:
@@ -197,10 +912,18 @@ func isEmpty(val reflect.Value) bool {
 
 func isEmptyJson(msg json.RawMessage) bool {
 	data := bytes.TrimSpace(msg)
-	switch string(data[0]) {
+	if len(data) == 0 {
+		return true
+	}
+	switch string(data) {
 	case `null`, `false`, `0`, `""`:
 		return true
 	}
+	if data[0] == '-' || (data[0] >= '0' && data[0] <= '9') {
+		//other forms of zero: 0.0, -0, 0e1
+		var n float64
+		return json.Unmarshal(data, &n) == nil && n == 0
+	}
 	if (data[0] == '{' && data[len(data)-1] == '}') ||
 		(data[0] == '[' && data[len(data)-1] == ']') {
 		data = bytes.TrimSpace(data[1 : len(data)-1])